@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/narik41/tictactoe-server/internal"
+)
+
+// envPrefix is put in front of a flag's name, upper cased and with dashes
+// turned into underscores, to get the environment variable that sets it,
+// e.g. TICTACTOE_WS_ADDR for -ws-addr.
+const envPrefix = "TICTACTOE_"
+
+// Config is everything the server can be configured with. Values are taken
+// from the defaults, then the JSON config file, then the environment and
+// finally the command line, each overriding the one before.
+type Config struct {
+	Listen   ListenConfig   `json:"listen"`
+	TLS      TLSConfig      `json:"tls"`
+	Timeouts TimeoutsConfig `json:"timeouts"`
+	Game     GameConfig     `json:"game"`
+	Login    LoginConfig    `json:"login"`
+	Cleanup  CleanupConfig  `json:"cleanup"`
+	Storage  StorageConfig  `json:"storage"`
+	Logging  LoggingConfig  `json:"logging"`
+}
+
+type ListenConfig struct {
+	Addr          string `json:"addr"`           // address of the TCP listener
+	WebSocketAddr string `json:"websocket_addr"` // address of the websocket listener, empty disables it
+	WebSocketPath string `json:"websocket_path"` // path the websocket endpoint is served at
+
+	// WebSocketOrigins are the origins of the web pages allowed to open a
+	// websocket, e.g. "https://play.example.com". Empty allows any.
+	WebSocketOrigins []string `json:"websocket_origins"`
+}
+
+type TLSConfig struct {
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	MinVersion string `json:"min_version"`
+	ClientAuth string `json:"client_auth"`
+	ClientCA   string `json:"client_ca"`
+	SelfSigned bool   `json:"self_signed"`
+}
+
+type TimeoutsConfig struct {
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	Idle              Duration `json:"idle"`
+	ResumeGrace       Duration `json:"resume_grace"` // how long a dropped player keeps its seat
+	Shutdown          Duration `json:"shutdown"`     // how long games in progress may delay a shutdown
+}
+
+type GameConfig struct {
+	MoveTime       Duration `json:"move_time"`
+	ClockInitial   Duration `json:"clock_initial"`
+	ClockIncrement Duration `json:"clock_increment"`
+	DuplicateLogin string   `json:"duplicate_login"`
+}
+
+type LoginConfig struct {
+	MaxFailures int      `json:"max_failures"` // failed logins and registrations allowed per username and per address, 0 for no limit
+	Window      Duration `json:"window"`       // period they are counted in
+}
+
+type CleanupConfig struct {
+	Interval  Duration `json:"interval"`
+	Completed Duration `json:"completed"`
+	Abandoned Duration `json:"abandoned"`
+	MaxAge    Duration `json:"max_age"`
+}
+
+type StorageConfig struct {
+	Users     string `json:"users"`      // memory or file
+	UsersPath string `json:"users_path"` // path of the user store when Users is file
+	DevUsers  bool   `json:"dev_users"`  // add the well known development accounts
+}
+
+type LoggingConfig struct {
+	File string `json:"file"` // log file to append to, empty logs to stderr
+	UTC  bool   `json:"utc"`  // timestamps in UTC instead of local time
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen: ListenConfig{
+			Addr:          "localhost:9000",
+			WebSocketAddr: "localhost:9001",
+			WebSocketPath: "/ws",
+		},
+		TLS: TLSConfig{
+			MinVersion: "1.2",
+			ClientAuth: string(internal.ClientAuthNone),
+		},
+		Timeouts: TimeoutsConfig{
+			HeartbeatInterval: Duration(15 * time.Second),
+			Idle:              Duration(45 * time.Second),
+			ResumeGrace:       Duration(30 * time.Second),
+			Shutdown:          Duration(2 * time.Minute),
+		},
+		Game: GameConfig{
+			DuplicateLogin: string(internal.DuplicateLoginReject),
+		},
+		Login: LoginConfig{
+			MaxFailures: 10,
+			Window:      Duration(time.Minute),
+		},
+		Cleanup: CleanupConfig{
+			Interval:  Duration(time.Minute),
+			Completed: Duration(5 * time.Minute),
+			Abandoned: Duration(time.Minute),
+			MaxAge:    Duration(24 * time.Hour),
+		},
+		Storage: StorageConfig{
+			Users:     "memory",
+			UsersPath: "users.json",
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the config file
+// named by -config, the environment and args, and validates it.
+func LoadConfig(args []string) (Config, error) {
+	// the first pass only finds the config file, the flags are applied
+	// again on top of it in the second
+	config := DefaultConfig()
+	path, err := parseFlags(&config, args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config = DefaultConfig()
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if _, err := parseFlags(&config, args); err != nil {
+		return Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// parseFlags sets config from the environment and then from args. It
+// returns the path of the config file, if any.
+func parseFlags(config *Config, args []string) (string, error) {
+	fs := flag.NewFlagSet("tictactoe-server", flag.ContinueOnError)
+	path := fs.String("config", "", "path of a JSON config file")
+
+	fs.StringVar(&config.Listen.Addr, "addr", config.Listen.Addr, "address of the game server")
+	fs.StringVar(&config.Listen.WebSocketAddr, "ws-addr", config.Listen.WebSocketAddr, "address of the websocket endpoint, empty disables it")
+	fs.StringVar(&config.Listen.WebSocketPath, "ws-path", config.Listen.WebSocketPath, "path of the websocket endpoint")
+	fs.Var((*stringList)(&config.Listen.WebSocketOrigins), "ws-origins", "comma separated `origins` of the web pages allowed to open a websocket, empty allows any")
+
+	fs.StringVar(&config.TLS.Cert, "tls-cert", config.TLS.Cert, "PEM certificate of the server, enables TLS together with -tls-key")
+	fs.StringVar(&config.TLS.Key, "tls-key", config.TLS.Key, "PEM private key of the server")
+	fs.StringVar(&config.TLS.MinVersion, "tls-min-version", config.TLS.MinVersion, "lowest TLS version accepted: 1.2 or 1.3")
+	fs.StringVar(&config.TLS.ClientAuth, "tls-client-auth", config.TLS.ClientAuth, "client certificate auth: none, optional or require")
+	fs.StringVar(&config.TLS.ClientCA, "tls-client-ca", config.TLS.ClientCA, "PEM bundle of the CAs trusted for client certificates")
+	fs.BoolVar(&config.TLS.SelfSigned, "tls-self-signed", config.TLS.SelfSigned, "serve TLS with a generated self-signed certificate, for local testing only")
+
+	fs.DurationVar((*time.Duration)(&config.Timeouts.HeartbeatInterval), "heartbeat-interval", time.Duration(config.Timeouts.HeartbeatInterval), "how often clients are pinged, 0 disables pings")
+	fs.DurationVar((*time.Duration)(&config.Timeouts.Idle), "idle-timeout", time.Duration(config.Timeouts.Idle), "how long a silent client is kept connected, 0 keeps it forever")
+	fs.DurationVar((*time.Duration)(&config.Timeouts.ResumeGrace), "resume-grace", time.Duration(config.Timeouts.ResumeGrace), "how long a player who dropped out of a game keeps its seat")
+	fs.DurationVar((*time.Duration)(&config.Timeouts.Shutdown), "shutdown-timeout", time.Duration(config.Timeouts.Shutdown), "how long games in progress may keep the server alive after a shutdown signal")
+
+	fs.DurationVar((*time.Duration)(&config.Game.MoveTime), "move-time", time.Duration(config.Game.MoveTime), "time limit for a single move, 0 for none")
+	fs.DurationVar((*time.Duration)(&config.Game.ClockInitial), "clock-initial", time.Duration(config.Game.ClockInitial), "total thinking time of each player, 0 for none")
+	fs.DurationVar((*time.Duration)(&config.Game.ClockIncrement), "clock-increment", time.Duration(config.Game.ClockIncrement), "time added to a player's total after each move")
+	fs.StringVar(&config.Game.DuplicateLogin, "duplicate-login", config.Game.DuplicateLogin, "what to do when a logged in user logs in again: reject or kick")
+
+	fs.IntVar(&config.Login.MaxFailures, "login-max-failures", config.Login.MaxFailures, "failed logins and registrations allowed per username and per address within -login-window, 0 for no limit")
+	fs.DurationVar((*time.Duration)(&config.Login.Window), "login-window", time.Duration(config.Login.Window), "period failed logins and registrations are counted in")
+
+	fs.DurationVar((*time.Duration)(&config.Cleanup.Interval), "cleanup-interval", time.Duration(config.Cleanup.Interval), "how often finished games are cleaned up")
+	fs.DurationVar((*time.Duration)(&config.Cleanup.Completed), "cleanup-completed", time.Duration(config.Cleanup.Completed), "how long a completed game is kept")
+	fs.DurationVar((*time.Duration)(&config.Cleanup.Abandoned), "cleanup-abandoned", time.Duration(config.Cleanup.Abandoned), "how long an abandoned game is kept")
+	fs.DurationVar((*time.Duration)(&config.Cleanup.MaxAge), "cleanup-max-age", time.Duration(config.Cleanup.MaxAge), "how long a game that is not in progress is kept after it was created")
+
+	fs.StringVar(&config.Storage.Users, "user-store", config.Storage.Users, "where users are kept: memory or file")
+	fs.StringVar(&config.Storage.UsersPath, "user-store-path", config.Storage.UsersPath, "path of the user store when -user-store=file")
+	fs.BoolVar(&config.Storage.DevUsers, "dev-users", config.Storage.DevUsers, "add the accounts narik and santo with their names as passwords, for local development only")
+
+	fs.StringVar(&config.Logging.File, "log-file", config.Logging.File, "file to append the log to, empty logs to stderr")
+	fs.BoolVar(&config.Logging.UTC, "log-utc", config.Logging.UTC, "log timestamps in UTC")
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+		}
+	})
+	if envErr != nil {
+		return "", envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return *path, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports the first setting the server cannot run with.
+func (c Config) Validate() error {
+	if c.Listen.Addr == "" {
+		return errors.New("the game server needs a listen address")
+	}
+	if c.Listen.WebSocketAddr != "" && !strings.HasPrefix(c.Listen.WebSocketPath, "/") {
+		return fmt.Errorf("websocket path %q must start with /", c.Listen.WebSocketPath)
+	}
+	for _, origin := range c.Listen.WebSocketOrigins {
+		if !strings.Contains(origin, "://") {
+			return fmt.Errorf("websocket origin %q must include the scheme, e.g. https://example.com", origin)
+		}
+	}
+
+	policy := internal.DuplicateLoginPolicy(c.Game.DuplicateLogin)
+	if policy != internal.DuplicateLoginReject && policy != internal.DuplicateLoginKick {
+		return fmt.Errorf("unknown duplicate login policy %q", c.Game.DuplicateLogin)
+	}
+
+	if c.Timeouts.HeartbeatInterval < 0 || c.Timeouts.Idle < 0 || c.Timeouts.ResumeGrace < 0 || c.Timeouts.Shutdown < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.Timeouts.Idle > 0 && c.Timeouts.HeartbeatInterval >= c.Timeouts.Idle {
+		return fmt.Errorf("heartbeat interval %s must be shorter than the idle timeout %s", c.Timeouts.HeartbeatInterval, c.Timeouts.Idle)
+	}
+
+	if c.Game.MoveTime < 0 || c.Game.ClockInitial < 0 || c.Game.ClockIncrement < 0 {
+		return errors.New("time controls must not be negative")
+	}
+	if c.Game.ClockIncrement > 0 && c.Game.ClockInitial == 0 {
+		return errors.New("a clock increment needs a total clock, set -clock-initial")
+	}
+
+	if c.Login.MaxFailures < 0 {
+		return errors.New("login max failures must not be negative")
+	}
+	if c.Login.MaxFailures > 0 && c.Login.Window <= 0 {
+		return errors.New("a login failure limit needs a positive window")
+	}
+
+	if c.Cleanup.Interval <= 0 || c.Cleanup.Completed <= 0 || c.Cleanup.Abandoned <= 0 || c.Cleanup.MaxAge <= 0 {
+		return errors.New("cleanup interval and retention windows must be positive")
+	}
+
+	switch c.Storage.Users {
+	case "memory":
+	case "file":
+		if c.Storage.UsersPath == "" {
+			return errors.New("the file user store needs a path")
+		}
+	default:
+		return fmt.Errorf("unknown user store %q", c.Storage.Users)
+	}
+
+	return nil
+}
+
+func (c Config) TLSSettings() internal.TLS {
+	return internal.TLS{
+		CertFile:     c.TLS.Cert,
+		KeyFile:      c.TLS.Key,
+		MinVersion:   c.TLS.MinVersion,
+		ClientAuth:   internal.ClientAuth(c.TLS.ClientAuth),
+		ClientCAFile: c.TLS.ClientCA,
+		SelfSigned:   c.TLS.SelfSigned,
+	}
+}
+
+// stringList is a list flag written as comma separated values.
+type stringList []string
+
+func (l stringList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in the config file.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	return d.Set(value)
+}
@@ -1,37 +1,159 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal"
+	"github.com/narik41/tictactoe-server/internal/game"
 	"github.com/narik41/tictactoe-server/internal/repo"
 )
 
 func main() {
+	config, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if err := setupLogging(config.Logging); err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	log.Println("!!! Starting the tic tac toe server !!!")
 
-	// session
-	sessionManager := internal.NewSessionManager()
-	gameSessionManager := internal.NewGameSessionManager()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tlsConfig, err := config.TLSSettings().Config()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if config.TLS.SelfSigned {
+		log.Println("Serving TLS with a self-signed certificate, do not use this in production")
+	}
 
+	// session
+	sessionManager := internal.NewSessionManager(internal.DuplicateLoginPolicy(config.Game.DuplicateLogin))
 	responseSender := internal.NewResponseSender(sessionManager)
 
+	gameEndNotifier := internal.NewGameEndNotifier(sessionManager, responseSender)
+	gameSessionManager := internal.NewGameSessionManager(game.TimeControl{
+		PerMove:   time.Duration(config.Game.MoveTime),
+		Initial:   time.Duration(config.Game.ClockInitial),
+		Increment: time.Duration(config.Game.ClockIncrement),
+	}, internal.GameRetention{
+		Completed: time.Duration(config.Cleanup.Completed),
+		Abandoned: time.Duration(config.Cleanup.Abandoned),
+		MaxAge:    time.Duration(config.Cleanup.MaxAge),
+	}, gameEndNotifier.FlagFall, sessionManager.IsPresent)
+	go gameSessionManager.CleanupLoop(ctx, time.Duration(config.Cleanup.Interval))
+
 	queue := internal.NewSessionQueue(gameSessionManager, responseSender)
 	queue.Start()
 
 	// repo
-	userRepo := repo.NewUserRepo()
+	userRepo, err := newUserRepo(config.Storage)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if config.Storage.DevUsers {
+		log.Println("Adding the development accounts, do not use this in production")
+		if err := repo.SeedDevUsers(userRepo); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
 
 	// register msg handler
 	router := internal.NewMessageRouter()
-	router.RegisterHandler(core.MSG_LOGIN_PAYLOAD, internal.NewLoginHandler(userRepo, queue, sessionManager))
-	router.RegisterHandler(core.PLAYER_MOVE, internal.NewPlayerMoveHandler(gameSessionManager))
+	router.Use(internal.RecoverMiddleware, internal.LoggingMiddleware)
+	loginLimiter := internal.NewLoginLimiter(config.Login.MaxFailures, time.Duration(config.Login.Window))
+	loginHandler := internal.NewLoginHandler(userRepo, queue, sessionManager, gameSessionManager, responseSender, loginLimiter)
+	router.RegisterHandler(core.MSG_LOGIN_PAYLOAD, loginHandler)
+	router.RegisterHandler(internal.REGISTER, internal.NewRegisterHandler(userRepo, sessionManager, loginHandler, loginLimiter))
+	router.RegisterHandler(core.PLAYER_MOVE, internal.NewPlayerMoveHandler(gameSessionManager, sessionManager))
+	router.RegisterHandler(internal.RESIGN, internal.NewResignHandler(gameSessionManager, sessionManager))
+	router.RegisterHandler(internal.OFFER_DRAW, internal.NewOfferDrawHandler(gameSessionManager, responseSender))
+	router.RegisterHandler(internal.RESPOND_DRAW, internal.NewRespondDrawHandler(gameSessionManager, sessionManager, responseSender))
+	router.RegisterHandler(internal.REMATCH, internal.NewRematchHandler(gameSessionManager, sessionManager, responseSender))
+	router.RegisterHandler(internal.DECLINE_REMATCH, internal.NewDeclineRematchHandler(gameSessionManager, sessionManager, queue, responseSender))
+	router.RegisterHandler(internal.PING, internal.NewPingHandler())
+	router.RegisterHandler(internal.PONG, internal.NewPongHandler())
+	router.RegisterHandler(internal.SET_FRAMING, internal.NewFramingHandler(sessionManager, responseSender))
+	router.RegisterHandler(internal.RESUME, internal.NewResumeHandler(sessionManager, gameSessionManager, queue, responseSender))
+
+	disconnectHandler := internal.NewDisconnectHandler(sessionManager, gameSessionManager, queue, responseSender, time.Duration(config.Timeouts.ResumeGrace))
 
-	server := internal.NewServer(sessionManager, gameSessionManager, router)
-	err := server.Start("localhost:9000")
+	server := internal.NewServer(sessionManager, gameSessionManager, queue, responseSender, router, disconnectHandler, internal.Heartbeat{
+		Interval:    time.Duration(config.Timeouts.HeartbeatInterval),
+		IdleTimeout: time.Duration(config.Timeouts.Idle),
+	}, tlsConfig)
+	if config.Listen.WebSocketAddr != "" {
+		go func() {
+			if err := server.StartWebSocket(ctx, config.Listen.WebSocketAddr, config.Listen.WebSocketPath, config.Listen.WebSocketOrigins); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	err = server.Start(ctx, config.Listen.Addr)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	// restore the default signal handling, so a second signal kills a
+	// server that takes too long to drain
+	stop()
+
+	log.Println("Shutdown signal received, draining games")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeouts.Shutdown))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown incomplete: %v", err)
+		return
+	}
+	log.Println("!!! Tic tac toe server stopped !!!")
+}
+
+func newUserRepo(storage StorageConfig) (repo.UserRepo, error) {
+	switch storage.Users {
+	case "memory":
+		return repo.NewUserRepo()
+	case "file":
+		return repo.NewFileUserRepo(storage.UsersPath)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", storage.Users)
+	}
+}
+
+// setupLogging points the standard logger at the configured output.
+func setupLogging(logging LoggingConfig) error {
+	if logging.UTC {
+		log.SetFlags(log.Flags() | log.LUTC)
+	}
+	if logging.File == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	log.SetOutput(file)
+	return nil
 }
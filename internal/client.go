@@ -1,15 +1,19 @@
 package internal
 
 import (
-	"net"
+	"github.com/narik41/tictactoe-server/internal/transport"
 )
 
 type Client struct {
-	Conn net.Conn
+	Conn transport.Conn
 }
 
-func NewClient(conn net.Conn) *Client {
+func NewClient(conn transport.Conn) *Client {
 	return &Client{
 		Conn: conn,
 	}
 }
+
+func (c *Client) Close() error {
+	return c.Conn.Close()
+}
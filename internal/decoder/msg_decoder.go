@@ -1,44 +1,30 @@
 package decoder
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 
 	"github.com/narik41/tictactoe-helper/core"
 )
 
-type MessageDecoder struct {
-	rw *bufio.ReadWriter
-}
+type MessageDecoder struct{}
 
-func NewMessageDecoder(rw *bufio.ReadWriter) *MessageDecoder {
-	return &MessageDecoder{
-		rw: rw,
-	}
+func NewMessageDecoder() *MessageDecoder {
+	return &MessageDecoder{}
 }
 
-func (d *MessageDecoder) Decode() (*DecodedMessage, error) {
-	// Step 1: Read line until newline
-	line, err := d.rw.Reader.ReadBytes('\n')
-	if err != nil {
-		if err == io.EOF {
-			return nil, io.EOF
-		}
-		return nil, fmt.Errorf("failed to read message: %w", err)
-	}
-
-	// Step 2: Trim whitespace
-	line = bytes.TrimSpace(line)
+// Decode decodes one message as read from the transport.
+func (d *MessageDecoder) Decode(data []byte) (*DecodedMessage, error) {
+	// Step 1: Trim whitespace
+	line := bytes.TrimSpace(data)
 
 	if len(line) == 0 {
 		return nil, fmt.Errorf("empty message")
 	}
 
-	// Step 3: Check if base64 encoded (wrapped in quotes)
+	// Step 2: Check if base64 encoded (wrapped in quotes)
 	if line[0] == '"' {
 		var base64Str string
 		if err := json.Unmarshal(line, &base64Str); err != nil {
@@ -54,13 +40,13 @@ func (d *MessageDecoder) Decode() (*DecodedMessage, error) {
 		line = decoded
 	}
 
-	// Step 4: Parse base message structure
+	// Step 3: Parse base message structure
 	var msg core.TicTacToeMessage
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return nil, fmt.Errorf("invalid JSON: %w", err)
 	}
 
-	// Step 5: Validate required fields
+	// Step 4: Validate required fields
 	if msg.MessageId == "" {
 		return nil, fmt.Errorf("message_id is required")
 	}
@@ -71,7 +57,7 @@ func (d *MessageDecoder) Decode() (*DecodedMessage, error) {
 		return nil, fmt.Errorf("timestamp is required")
 	}
 
-	// Step 6: Extract version-specific payload
+	// Step 5: Extract version-specific payload
 	var messageType core.Version1MessageType
 	var payloadData interface{}
 
@@ -88,7 +74,7 @@ func (d *MessageDecoder) Decode() (*DecodedMessage, error) {
 		return nil, fmt.Errorf("unsupported version: %s", msg.Version)
 	}
 
-	// Step 7: Return decoded message
+	// Step 6: Return decoded message
 	return &DecodedMessage{
 		MessageId:   msg.MessageId,
 		Version:     msg.Version,
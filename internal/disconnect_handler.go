@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"log"
+	"time"
+
+	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/game"
+)
+
+// DisconnectHandler is the single place where a session whose connection
+// went away is cleaned up: it forgets the session, takes it off the
+// matchmaking queue and out of its game, and tells the opponent that the
+// game was abandoned. A player dropping out of a game in progress keeps its
+// seat for the grace period so it can resume the session.
+type DisconnectHandler struct {
+	sessionManager     *SessionManager
+	gameSessionManager *GameSessionManager
+	queue              *SessionQueue
+	sender             *ResponseSender
+	gracePeriod        time.Duration
+}
+
+func NewDisconnectHandler(sessionManager *SessionManager, gameSessionManager *GameSessionManager, queue *SessionQueue, sender *ResponseSender, gracePeriod time.Duration) *DisconnectHandler {
+	return &DisconnectHandler{
+		sessionManager:     sessionManager,
+		gameSessionManager: gameSessionManager,
+		queue:              queue,
+		sender:             sender,
+		gracePeriod:        gracePeriod,
+	}
+}
+
+// Handle cleans up after the session. It is safe to call more than once;
+// only the first call has an effect.
+func (d *DisconnectHandler) Handle(session *Session) {
+	if !d.sessionManager.RemoveSession(session.Id) {
+		return
+	}
+	log.Printf("Cleaning up disconnected session %s (%s)", session.Id, session.Username)
+
+	session.Close()
+
+	// the session is only queued while waiting for a pair. Closing it
+	// first matters: the queue seats players under the lock Remove takes,
+	// so once Remove returns the session is either out of the queue or
+	// seated in a game in progress
+	d.queue.Remove(session.Id)
+
+	if d.holdSeat(session) {
+		return
+	}
+
+	d.leaveGame(session)
+}
+
+// holdSeat keeps the session resumable if it drops out of a game in
+// progress, and tells the opponent to wait for it.
+func (d *DisconnectHandler) holdSeat(session *Session) bool {
+	if d.gracePeriod <= 0 || session.ResumeToken == "" {
+		return false
+	}
+
+	gameSession, err := d.gameSessionManager.GetSessionByPlayer(session.Id)
+	if err != nil || gameSession.GetStatus() != game.SessionInProgress {
+		return false
+	}
+
+	d.sessionManager.Hold(session, d.gracePeriod, d.leaveGame)
+
+	err = d.sender.SendToOpponent(gameSession, session.Id, &HandlerResponse{
+		MessageType: OPPONENT_DISCONNECTED,
+		Payload: map[string]interface{}{
+			"message":      "Opponent disconnected, waiting for it to reconnect...",
+			"wait_seconds": int(d.gracePeriod.Seconds()),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to notify opponent of session %s about disconnect: %v", session.Id, err)
+	}
+	return true
+}
+
+func (d *DisconnectHandler) leaveGame(session *Session) {
+	gameSession, err := d.gameSessionManager.GetSessionByPlayer(session.Id)
+	if err != nil {
+		return
+	}
+
+	status := gameSession.GetStatus()
+	opponent, opponentErr := gameSession.GetOpponentInfo(session.Id)
+
+	if err := d.gameSessionManager.RemovePlayerFromSession(session.Id); err != nil {
+		log.Printf("Failed to remove session %s from game %s: %v", session.Id, gameSession.Id, err)
+		return
+	}
+
+	if opponentErr != nil {
+		return
+	}
+
+	opponentSession, exists := d.sessionManager.GetSession(opponent.SessionID)
+	if !exists {
+		return
+	}
+
+	// the opponent of a finished game may be waiting for a rematch
+	if status == game.SessionCompleted {
+		cancelRematch(d.sender, d.queue, opponentSession, "Opponent left.")
+		return
+	}
+	if status != game.SessionInProgress {
+		return
+	}
+
+	if err := opponentSession.Transition(LoggedIn); err != nil {
+		log.Printf("Failed to return session %s to the lobby: %v", opponent.SessionID, err)
+		return
+	}
+	err = d.sender.Send(opponentSession, &HandlerResponse{
+		MessageType: core.GAME_END,
+		Payload:     NewGameEndPayload(gameSession),
+	})
+	if err != nil {
+		log.Printf("Failed to notify session %s about abandoned game %s: %v", opponent.SessionID, gameSession.Id, err)
+	}
+
+	// there is no one left for a rematch, so look for a new opponent
+	if err := d.queue.Enqueue(opponentSession); err != nil {
+		log.Printf("Failed to queue session %s after abandoned game %s: %v", opponent.SessionID, gameSession.Id, err)
+	}
+}
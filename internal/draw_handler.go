@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+)
+
+// OfferDrawHandler records a player's draw offer, relays it to the
+// opponent and confirms it to the player.
+type OfferDrawHandler struct {
+	gameSessionManager *GameSessionManager
+	sender             *ResponseSender
+}
+
+func NewOfferDrawHandler(gameSessionManager *GameSessionManager, sender *ResponseSender) OfferDrawHandler {
+	return OfferDrawHandler{
+		gameSessionManager: gameSessionManager,
+		sender:             sender,
+	}
+}
+
+func (a OfferDrawHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the draw offer.")
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gameSession.OfferDraw(sessionId); err != nil {
+		return nil, err
+	}
+
+	err = a.sender.SendToOpponent(gameSession, sessionId, &HandlerResponse{
+		MessageType: DRAW_OFFERED,
+		Payload: map[string]interface{}{
+			"message": "Opponent offers a draw.",
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to pass the draw offer of session %s on: %v", sessionId, err)
+	}
+
+	return &HandlerResponse{
+		MessageType: DRAW_OFFER_SENT,
+		Payload: map[string]interface{}{
+			"message": "Draw offered, waiting for the opponent.",
+		},
+	}, nil
+}
+
+func (a OfferDrawHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		IN_GAME,
+	}
+}
+
+// RespondDrawHandler accepts or declines the opponent's draw offer.
+type RespondDrawHandler struct {
+	gameSessionManager *GameSessionManager
+	sessionManager     *SessionManager
+	sender             *ResponseSender
+}
+
+func NewRespondDrawHandler(gameSessionManager *GameSessionManager, sessionManager *SessionManager, sender *ResponseSender) RespondDrawHandler {
+	return RespondDrawHandler{
+		gameSessionManager: gameSessionManager,
+		sessionManager:     sessionManager,
+		sender:             sender,
+	}
+}
+
+func (a RespondDrawHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the draw response.")
+	var respondPayload RespondDrawPayload
+	if err := decodePayload(msg, &respondPayload); err != nil {
+		return nil, err
+	}
+
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gameSession.RespondDraw(sessionId, respondPayload.Accept); err != nil {
+		return nil, err
+	}
+
+	if !respondPayload.Accept {
+		err = a.sender.SendToOpponent(gameSession, sessionId, &HandlerResponse{
+			MessageType: DRAW_DECLINED,
+			Payload: map[string]interface{}{
+				"message": "Opponent declined the draw.",
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to pass the draw decline of session %s on: %v", sessionId, err)
+		}
+
+		return &HandlerResponse{
+			MessageType: DRAW_DECLINE_SENT,
+			Payload: map[string]interface{}{
+				"message": "Draw declined, the game goes on.",
+			},
+		}, nil
+	}
+
+	a.sessionManager.ReturnToLobby(gameSession.GetBothPlayerSessionIDs())
+	return gameEndResponse(gameSession), nil
+}
+
+func (a RespondDrawHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		IN_GAME,
+	}
+}
@@ -0,0 +1,78 @@
+// Package errs is the catalogue of errors the server reports to clients.
+// Every error a client can cause carries one of the codes below, which are
+// part of the protocol and must not change.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Code string
+
+const (
+	CodeDecodeError    Code = "DECODE_ERROR"    // the message could not be decoded
+	CodeUnknownType    Code = "UNKNOWN_TYPE"    // no handler for the message type
+	CodeInvalidState   Code = "INVALID_STATE"   // the message is not allowed in the session's state
+	CodeInvalidPayload Code = "INVALID_PAYLOAD" // the payload does not fit the message type
+	CodeInternal       Code = "INTERNAL_ERROR"  // the server failed, details are only logged
+	CodeShuttingDown   Code = "SHUTTING_DOWN"   // the server is going down and starts no new games
+
+	CodeMessageTooLarge    Code = "MESSAGE_TOO_LARGE"   // the message exceeds the size limit, the connection is closed
+	CodeUnsupportedFraming Code = "UNSUPPORTED_FRAMING" // the connection cannot switch to the requested framing
+
+	CodeAuthFailed        Code = "AUTH_FAILED"        // wrong username or password
+	CodeAlreadyLoggedIn   Code = "ALREADY_LOGGED_IN"  // the user is logged in on another connection
+	CodeUsernameTaken     Code = "USERNAME_TAKEN"     // an account with the username exists
+	CodeInvalidUsername   Code = "INVALID_USERNAME"   // the username breaks the naming rules
+	CodeInvalidPassword   Code = "INVALID_PASSWORD"   // the password is too short or too long
+	CodeResumeFailed      Code = "RESUME_FAILED"      // the resume token is unknown or expired
+	CodeTooManyAttempts   Code = "TOO_MANY_ATTEMPTS"  // too many failed logins or registrations, the client has to wait
+	CodeAlreadyRegistered Code = "ALREADY_REGISTERED" // the connection already created an account
+
+	CodeNotInGame          Code = "NOT_IN_GAME"          // the player has no game
+	CodeGameNotFound       Code = "GAME_NOT_FOUND"       // the game is gone, e.g. cleaned up after it ended
+	CodeGameNotInProgress  Code = "GAME_NOT_IN_PROGRESS" // the game has not started or is over
+	CodeGameNotFinished    Code = "GAME_NOT_FINISHED"    // the game is still being played
+	CodeOpponentLeft       Code = "OPPONENT_LEFT"        // the opponent is gone
+	CodeInvalidPosition    Code = "INVALID_POSITION"     // the position is off the board
+	CodeNotYourTurn        Code = "NOT_YOUR_TURN"        // the opponent is to move
+	CodeCellOccupied       Code = "CELL_OCCUPIED"        // the position is already played
+	CodeSymbolMismatch     Code = "SYMBOL_MISMATCH"      // the claimed symbol is not the player's
+	CodeTimeUp             Code = "TIME_UP"              // the player ran out of time
+	CodeDrawAlreadyOffered Code = "DRAW_ALREADY_OFFERED" // a draw offer is pending
+	CodeNoDrawOffer        Code = "NO_DRAW_OFFER"        // there is no draw offer to answer
+	CodeRematchRequested   Code = "REMATCH_REQUESTED"    // the player already asked for a rematch
+)
+
+// Error is an error with a code from the catalogue. Its message is shown
+// to the client.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func New(code Code, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func Newf(code Code, format string, args ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// CodeOf returns the code of the first Error in err's chain, or
+// CodeInternal if there is none.
+func CodeOf(err error) Code {
+	var codedErr *Error
+	if errors.As(err, &codedErr) {
+		return codedErr.Code
+	}
+	return CodeInternal
+}
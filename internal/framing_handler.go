@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+// FramingHandler switches a stream connection to another framing. The
+// client sends SET_FRAMING in the current framing and waits for
+// FRAMING_CHANGED, which is the last message it gets in the old framing;
+// from then on both directions use the new one.
+type FramingHandler struct {
+	sessionManager *SessionManager
+	sender         *ResponseSender
+}
+
+func NewFramingHandler(sessionManager *SessionManager, sender *ResponseSender) FramingHandler {
+	return FramingHandler{
+		sessionManager: sessionManager,
+		sender:         sender,
+	}
+}
+
+func (a FramingHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the framing change.")
+	var payload FramingPayload
+	if err := decodePayload(msg, &payload); err != nil {
+		return nil, err
+	}
+	if !payload.Framing.Valid() {
+		return nil, errs.Newf(errs.CodeInvalidPayload, "unknown framing %q", payload.Framing)
+	}
+
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+	framer, ok := clientSession.Client.Conn.(transport.Framer)
+	if !ok {
+		return nil, errs.New(errs.CodeUnsupportedFraming, "the connection frames messages itself")
+	}
+
+	// handlers run on the reading goroutine, so the next read already uses
+	// the new framing
+	if err := framer.SetReadFraming(payload.Framing); err != nil {
+		return nil, err
+	}
+
+	err := a.sender.SendFramingSwitch(clientSession, &HandlerResponse{
+		MessageType: FRAMING_CHANGED,
+		Payload:     &payload,
+		InReplyTo:   msg.MessageId,
+	}, payload.Framing)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (a FramingHandler) RequiredStates() []SessionState {
+	return nil
+}
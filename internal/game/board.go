@@ -13,6 +13,18 @@ const (
 	SymbolEmpty Symbol = ""
 )
 
+// Opponent returns the symbol playing against s.
+func (s Symbol) Opponent() Symbol {
+	switch s {
+	case SymbolX:
+		return SymbolO
+	case SymbolO:
+		return SymbolX
+	default:
+		return SymbolEmpty
+	}
+}
+
 type BoardCell struct {
 	Symbol Symbol
 }
@@ -0,0 +1,135 @@
+package game
+
+import "time"
+
+// TimeControl describes how much thinking time the players get. The zero
+// value means untimed games.
+type TimeControl struct {
+	PerMove   time.Duration // limit for every single move, zero for none
+	Initial   time.Duration // total time each player starts with, zero for none
+	Increment time.Duration // added to a player's total after each of its moves
+}
+
+func (tc TimeControl) IsTimed() bool {
+	return tc.PerMove > 0 || tc.Initial > 0
+}
+
+// Clock is a snapshot of a timed game's clocks.
+type Clock struct {
+	Remaining     map[Symbol]time.Duration // total time left per player, nil without a total clock
+	TurnRemaining time.Duration            // time the player to move has left for this move
+}
+
+// GetClock returns the current state of the clocks, or false for an
+// untimed game.
+func (gs *GameSession) GetClock() (Clock, bool) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	if !gs.TimeControl.IsTimed() {
+		return Clock{}, false
+	}
+
+	now := time.Now()
+	clock := Clock{}
+	if gs.TimeControl.Initial > 0 {
+		clock.Remaining = make(map[Symbol]time.Duration, len(gs.remaining))
+		for symbol, remaining := range gs.remaining {
+			clock.Remaining[symbol] = remaining
+		}
+		if gs.Status == SessionInProgress {
+			turn := gs.Game.GetCurrentTurn()
+			clock.Remaining[turn] = max(clock.Remaining[turn]-now.Sub(gs.turnStartedAt), 0)
+		}
+	}
+	if gs.Status == SessionInProgress {
+		clock.TurnRemaining = max(gs.turnLimit()-now.Sub(gs.turnStartedAt), 0)
+	}
+	return clock, true
+}
+
+// startClock starts the first turn. The caller must hold the lock.
+func (gs *GameSession) startClock(now time.Time) {
+	if !gs.TimeControl.IsTimed() {
+		return
+	}
+
+	if gs.TimeControl.Initial > 0 {
+		gs.remaining = map[Symbol]time.Duration{
+			SymbolX: gs.TimeControl.Initial,
+			SymbolO: gs.TimeControl.Initial,
+		}
+	}
+	gs.startTurn(now)
+}
+
+// startTurn starts the clock of the player to move and arms the timer that
+// ends the game when it runs out. The caller must hold the lock.
+func (gs *GameSession) startTurn(now time.Time) {
+	gs.stopClock()
+	gs.turnStartedAt = now
+	gs.clockTurn++
+
+	turn := gs.clockTurn
+	gs.flagTimer = time.AfterFunc(gs.turnLimit(), func() {
+		gs.flagFall(turn)
+	})
+}
+
+// turnLimit is how long the player to move may take in total for the
+// current move. The caller must hold the lock.
+func (gs *GameSession) turnLimit() time.Duration {
+	limit := gs.TimeControl.PerMove
+	if gs.TimeControl.Initial > 0 {
+		remaining := gs.remaining[gs.Game.GetCurrentTurn()]
+		if limit == 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+	return limit
+}
+
+// isFlagged reports whether the player to move has run out of time. The
+// caller must hold the lock.
+func (gs *GameSession) isFlagged(now time.Time) bool {
+	return gs.TimeControl.IsTimed() && now.Sub(gs.turnStartedAt) >= gs.turnLimit()
+}
+
+// chargeClock takes the time spent on the move just made off the mover's
+// total and adds the increment. The caller must hold the lock.
+func (gs *GameSession) chargeClock(mover Symbol, now time.Time) {
+	if gs.TimeControl.Initial == 0 {
+		return
+	}
+	gs.remaining[mover] += gs.TimeControl.Increment - now.Sub(gs.turnStartedAt)
+}
+
+// stopClock disarms the flag timer. The caller must hold the lock.
+func (gs *GameSession) stopClock() {
+	if gs.flagTimer != nil {
+		gs.flagTimer.Stop()
+		gs.flagTimer = nil
+	}
+}
+
+// flagFall ends the game as a loss for the player to move if its time for
+// the given turn ran out, and reports it through OnFlagFall.
+func (gs *GameSession) flagFall(turn int) {
+	gs.mu.Lock()
+	if gs.Status != SessionInProgress || gs.clockTurn != turn {
+		gs.mu.Unlock()
+		return
+	}
+
+	if gs.TimeControl.Initial > 0 {
+		gs.remaining[gs.Game.GetCurrentTurn()] = 0
+	}
+	gs.Game.Concede(gs.Game.GetCurrentTurn())
+	gs.finish(ReasonTimeout, time.Now())
+	onFlagFall := gs.OnFlagFall
+	gs.mu.Unlock()
+
+	if onFlagFall != nil {
+		onFlagFall(gs)
+	}
+}
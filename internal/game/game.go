@@ -1,6 +1,6 @@
 package game
 
-import "fmt"
+import "github.com/narik41/tictactoe-server/internal/errs"
 
 type GameStatus string
 
@@ -15,6 +15,8 @@ type Game struct {
 	currentTurn Symbol
 	status      GameStatus
 	winner      Symbol
+	winningLine []int
+	moveCount   int
 }
 
 func NewGame() *Game {
@@ -29,22 +31,23 @@ func NewGame() *Game {
 func (g *Game) MakeMove(position int, symbol Symbol) error {
 
 	if position < 0 || position > 8 {
-		return fmt.Errorf("invalid position: position ", position)
+		return errs.Newf(errs.CodeInvalidPosition, "invalid position: %d", position)
 	}
 
 	if symbol != g.currentTurn {
-		return fmt.Errorf("not your turn, current turn: %s", g.currentTurn)
+		return errs.Newf(errs.CodeNotYourTurn, "not your turn, current turn: %s", g.currentTurn)
 	}
 
 	if g.status != StatusInProgress {
-		return fmt.Errorf("game is already over")
+		return errs.New(errs.CodeGameNotInProgress, "game is already over")
 	}
 
 	if g.board.GetCell(position) != SymbolEmpty {
-		return fmt.Errorf("cell already occupied")
+		return errs.New(errs.CodeCellOccupied, "cell already occupied")
 	}
 
 	g.board.SetCell(position, symbol)
+	g.moveCount++
 	g.checkGameState()
 
 	if g.status == StatusInProgress {
@@ -54,11 +57,33 @@ func (g *Game) MakeMove(position int, symbol Symbol) error {
 	return nil
 }
 
+// Concede ends the game in progress as a win for the opponent of loser.
+func (g *Game) Concede(loser Symbol) error {
+	if g.status != StatusInProgress {
+		return errs.New(errs.CodeGameNotInProgress, "game is already over")
+	}
+
+	g.status = StatusWon
+	g.winner = loser.Opponent()
+	return nil
+}
+
+// AgreeDraw ends the game in progress as a draw.
+func (g *Game) AgreeDraw() error {
+	if g.status != StatusInProgress {
+		return errs.New(errs.CodeGameNotInProgress, "game is already over")
+	}
+
+	g.status = StatusDraw
+	return nil
+}
+
 func (g *Game) checkGameState() {
 
-	if winner := g.checkWinner(); winner != SymbolEmpty {
+	if winner, line := g.checkWinner(); winner != SymbolEmpty {
 		g.status = StatusWon
 		g.winner = winner
+		g.winningLine = line
 		return
 	}
 
@@ -69,7 +94,9 @@ func (g *Game) checkGameState() {
 	g.status = StatusInProgress
 }
 
-func (g *Game) checkWinner() Symbol {
+// checkWinner returns the symbol that completed a line and the positions of
+// that line.
+func (g *Game) checkWinner() (Symbol, []int) {
 
 	winningCombos := [][]int{
 		{0, 1, 2}, // Top row
@@ -87,11 +114,11 @@ func (g *Game) checkWinner() Symbol {
 		if first != SymbolEmpty &&
 			first == g.board.GetCell(combo[1]) &&
 			first == g.board.GetCell(combo[2]) {
-			return first
+			return first, combo
 		}
 	}
 
-	return SymbolEmpty
+	return SymbolEmpty, nil
 }
 
 func (g *Game) isBoardFull() bool {
@@ -117,3 +144,14 @@ func (g *Game) GetCurrentTurn() Symbol { return g.currentTurn }
 
 func (g *Game) IsGameEnd() bool         { return g.status == StatusWon || g.status == StatusDraw }
 func (g *Game) GetWinnerSymbol() Symbol { return g.winner }
+func (g *Game) GetStatus() GameStatus   { return g.status }
+func (g *Game) GetMoveCount() int       { return g.moveCount }
+
+// GetWinningLine returns the positions of the completed line, or nil if the
+// game was not won on the board.
+func (g *Game) GetWinningLine() []int {
+	if g.winningLine == nil {
+		return nil
+	}
+	return append([]int(nil), g.winningLine...)
+}
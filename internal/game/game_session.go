@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/narik41/tictactoe-server/internal/errs"
 )
 
 type GameSessionStatus string
@@ -16,16 +18,38 @@ const (
 	SessionAbandoned         GameSessionStatus = "ABANDONED"
 )
 
+// EndReason tells why a game session ended.
+type EndReason string
+
+const (
+	ReasonLine      EndReason = "LINE"       // a player completed a line
+	ReasonBoardFull EndReason = "BOARD_FULL" // the board filled up without a line
+	ReasonAbandoned EndReason = "ABANDONED"
+	ReasonTimeout   EndReason = "TIMEOUT"
+	ReasonResigned  EndReason = "RESIGNATION"
+	ReasonDraw      EndReason = "DRAW_AGREED"
+)
+
 type GameSession struct {
-	Id        string
-	Game      *Game
-	PlayerX   *PlayerInfo
-	PlayerO   *PlayerInfo
-	Status    GameSessionStatus
-	CreatedAt time.Time
-	StartedAt time.Time
-	EndedAt   time.Time
-	mu        sync.RWMutex
+	Id          string
+	Game        *Game
+	PlayerX     *PlayerInfo
+	PlayerO     *PlayerInfo
+	Status      GameSessionStatus
+	CreatedAt   time.Time
+	StartedAt   time.Time
+	EndedAt     time.Time
+	EndReason   EndReason
+	TimeControl TimeControl
+	OnFlagFall  func(*GameSession) // called when a player runs out of time
+
+	drawOfferedBy      Symbol                   // player with a pending draw offer
+	rematchRequestedBy Symbol                   // player who wants to play again after the game
+	remaining          map[Symbol]time.Duration // total time left per player
+	turnStartedAt      time.Time
+	clockTurn          int // counts started turns so a stale flag timer is ignored
+	flagTimer          *time.Timer
+	mu                 sync.RWMutex
 }
 
 type PlayerInfo struct {
@@ -36,12 +60,23 @@ type PlayerInfo struct {
 	MyTurn    bool
 }
 
-func NewGameSession(sessionID string) *GameSession {
+// Move records a move as it was applied to the game.
+type Move struct {
+	Number   int // 1 for the first move of the game
+	Position int
+	Symbol   Symbol
+	Username string
+	Board    []string // the board after the move
+	NextTurn Symbol
+}
+
+func NewGameSession(sessionID string, timeControl TimeControl) *GameSession {
 	return &GameSession{
-		Id:        sessionID,
-		Game:      NewGame(),
-		Status:    SessionWaitingForPlayers,
-		CreatedAt: time.Now(),
+		Id:          sessionID,
+		Game:        NewGame(),
+		Status:      SessionWaitingForPlayers,
+		CreatedAt:   time.Now(),
+		TimeControl: timeControl,
 	}
 }
 
@@ -84,28 +119,65 @@ func (gs *GameSession) RemovePlayer(sessionID string) error {
 
 	if gs.PlayerX != nil && gs.PlayerX.SessionID == sessionID {
 		gs.PlayerX = nil
-		gs.handlePlayerDisconnect()
+		gs.handlePlayerDisconnect(SymbolX)
 		return nil
 	}
 
 	if gs.PlayerO != nil && gs.PlayerO.SessionID == sessionID {
 		gs.PlayerO = nil
-		gs.handlePlayerDisconnect()
+		gs.handlePlayerDisconnect(SymbolO)
 		return nil
 	}
 
 	return fmt.Errorf("player not found in session")
 }
 
-func (gs *GameSession) handlePlayerDisconnect() {
+// ReplacePlayer gives the seat of one connection session to another, e.g.
+// when the same user logs in again on a new connection.
+func (gs *GameSession) ReplacePlayer(oldSessionID, newSessionID string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.PlayerX != nil && gs.PlayerX.SessionID == oldSessionID {
+		gs.PlayerX.SessionID = newSessionID
+		return nil
+	}
+	if gs.PlayerO != nil && gs.PlayerO.SessionID == oldSessionID {
+		gs.PlayerO.SessionID = newSessionID
+		return nil
+	}
+	return fmt.Errorf("player not found in session")
+}
+
+// handlePlayerDisconnect ends a game in progress as a loss for the player
+// who left.
+func (gs *GameSession) handlePlayerDisconnect(leaver Symbol) {
 	if gs.Status == SessionInProgress {
+		gs.Game.Concede(leaver)
+		gs.stopClock()
 		gs.Status = SessionAbandoned
+		gs.EndReason = ReasonAbandoned
 		gs.EndedAt = time.Now()
 	} else {
 		gs.Status = SessionWaitingForPlayers
 	}
 }
 
+// Abandon ends a game in progress that both players left. There is no
+// winner.
+func (gs *GameSession) Abandon() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.Status != SessionInProgress {
+		return
+	}
+	gs.stopClock()
+	gs.Status = SessionAbandoned
+	gs.EndReason = ReasonAbandoned
+	gs.EndedAt = time.Now()
+}
+
 func (gs *GameSession) Start() error {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
@@ -120,36 +192,185 @@ func (gs *GameSession) Start() error {
 
 	gs.Status = SessionInProgress
 	gs.StartedAt = time.Now()
+	gs.startClock(gs.StartedAt)
 	// relay the message
 
 	return nil
 }
 
-func (gs *GameSession) MakeMove(sessionID string, position int) error {
+// MakeMove plays position for the player of the connection session and
+// returns the move as seen by the server.
+func (gs *GameSession) MakeMove(sessionID string, position int) (*Move, error) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
 
 	if gs.Status != SessionInProgress {
-		return fmt.Errorf("game is not in progress")
+		return nil, errs.New(errs.CodeGameNotInProgress, "game is not in progress")
 	}
 
 	playerSymbol, err := gs.getPlayerSymbol(sessionID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// the flag timer is about to end the game
+	now := time.Now()
+	if playerSymbol == gs.Game.GetCurrentTurn() && gs.isFlagged(now) {
+		return nil, errs.New(errs.CodeTimeUp, "time is up")
 	}
 
 	if err := gs.Game.MakeMove(position, playerSymbol); err != nil {
-		return err
+		return nil, err
+	}
+
+	if gs.TimeControl.IsTimed() {
+		gs.chargeClock(playerSymbol, now)
+	}
+
+	// moving instead of answering declines the opponent's draw offer
+	if gs.drawOfferedBy == playerSymbol.Opponent() {
+		gs.drawOfferedBy = SymbolEmpty
 	}
 
 	if gs.Game.IsGameEnd() {
-		gs.Status = SessionCompleted
-		gs.EndedAt = time.Now()
+		reason := ReasonLine
+		if gs.Game.GetStatus() == StatusDraw {
+			reason = ReasonBoardFull
+		}
+		gs.finish(reason, now)
+	} else if gs.TimeControl.IsTimed() {
+		gs.startTurn(now)
+	}
+
+	player := gs.PlayerX
+	if playerSymbol == SymbolO {
+		player = gs.PlayerO
+	}
+	return &Move{
+		Number:   gs.Game.GetMoveCount(),
+		Position: position,
+		Symbol:   playerSymbol,
+		Username: player.Username,
+		Board:    gs.Game.GetBoard().ToArray(),
+		NextTurn: gs.Game.GetCurrentTurn(),
+	}, nil
+}
+
+// Resign ends the game as a loss for the player.
+func (gs *GameSession) Resign(sessionID string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.Status != SessionInProgress {
+		return errs.New(errs.CodeGameNotInProgress, "game is not in progress")
+	}
+
+	playerSymbol, err := gs.getPlayerSymbol(sessionID)
+	if err != nil {
+		return err
 	}
 
+	if err := gs.Game.Concede(playerSymbol); err != nil {
+		return err
+	}
+	gs.finish(ReasonResigned, time.Now())
 	return nil
 }
 
+// OfferDraw records the player's offer of a draw. The offer stands until
+// the opponent responds to it or makes a move.
+func (gs *GameSession) OfferDraw(sessionID string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.Status != SessionInProgress {
+		return errs.New(errs.CodeGameNotInProgress, "game is not in progress")
+	}
+
+	playerSymbol, err := gs.getPlayerSymbol(sessionID)
+	if err != nil {
+		return err
+	}
+
+	switch gs.drawOfferedBy {
+	case playerSymbol:
+		return errs.New(errs.CodeDrawAlreadyOffered, "draw already offered")
+	case playerSymbol.Opponent():
+		return errs.New(errs.CodeDrawAlreadyOffered, "opponent already offered a draw")
+	}
+
+	gs.drawOfferedBy = playerSymbol
+	return nil
+}
+
+// RespondDraw accepts or declines the opponent's draw offer. Accepting it
+// ends the game as a draw.
+func (gs *GameSession) RespondDraw(sessionID string, accept bool) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.Status != SessionInProgress {
+		return errs.New(errs.CodeGameNotInProgress, "game is not in progress")
+	}
+
+	playerSymbol, err := gs.getPlayerSymbol(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if gs.drawOfferedBy != playerSymbol.Opponent() {
+		return errs.New(errs.CodeNoDrawOffer, "no draw offer to respond to")
+	}
+	gs.drawOfferedBy = SymbolEmpty
+
+	if !accept {
+		return nil
+	}
+
+	if err := gs.Game.AgreeDraw(); err != nil {
+		return err
+	}
+	gs.finish(ReasonDraw, time.Now())
+	return nil
+}
+
+// RequestRematch records that the player wants to play the same opponent
+// again once the game is over. It reports whether the opponent asked for a
+// rematch as well.
+func (gs *GameSession) RequestRematch(sessionID string) (bool, error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.Status != SessionCompleted {
+		return false, errs.New(errs.CodeGameNotFinished, "game is not finished")
+	}
+
+	playerSymbol, err := gs.getPlayerSymbol(sessionID)
+	if err != nil {
+		return false, err
+	}
+
+	switch gs.rematchRequestedBy {
+	case playerSymbol:
+		return false, errs.New(errs.CodeRematchRequested, "rematch already requested")
+	case playerSymbol.Opponent():
+		return true, nil
+	}
+
+	gs.rematchRequestedBy = playerSymbol
+	return false, nil
+}
+
+// finish marks the game as completed for the reason. The caller must hold
+// the lock.
+func (gs *GameSession) finish(reason EndReason, now time.Time) {
+	gs.stopClock()
+	gs.drawOfferedBy = SymbolEmpty
+	gs.Status = SessionCompleted
+	gs.EndReason = reason
+	gs.EndedAt = now
+}
+
 func (gs *GameSession) getPlayerSymbol(sessionID string) (Symbol, error) {
 	if gs.PlayerX != nil && gs.PlayerX.SessionID == sessionID {
 		return SymbolX, nil
@@ -157,7 +378,7 @@ func (gs *GameSession) getPlayerSymbol(sessionID string) (Symbol, error) {
 	if gs.PlayerO != nil && gs.PlayerO.SessionID == sessionID {
 		return SymbolO, nil
 	}
-	return SymbolEmpty, fmt.Errorf("player not in this game session")
+	return SymbolEmpty, errs.New(errs.CodeNotInGame, "player not in this game session")
 }
 
 func (gs *GameSession) GetPlayerInfo(sessionID string) (*PlayerInfo, error) {
@@ -170,6 +391,20 @@ func (gs *GameSession) GetPlayerInfo(sessionID string) (*PlayerInfo, error) {
 	if gs.PlayerO != nil && gs.PlayerO.SessionID == sessionID {
 		return gs.PlayerO, nil
 	}
+	return nil, errs.New(errs.CodeNotInGame, "player not found")
+}
+
+// GetPlayerBySymbol returns the player playing symbol.
+func (gs *GameSession) GetPlayerBySymbol(symbol Symbol) (*PlayerInfo, error) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	if gs.PlayerX != nil && gs.PlayerX.Symbol == symbol {
+		return gs.PlayerX, nil
+	}
+	if gs.PlayerO != nil && gs.PlayerO.Symbol == symbol {
+		return gs.PlayerO, nil
+	}
 	return nil, fmt.Errorf("player not found")
 }
 
@@ -181,15 +416,15 @@ func (gs *GameSession) GetOpponentInfo(sessionID string) (*PlayerInfo, error) {
 		if gs.PlayerO != nil {
 			return gs.PlayerO, nil
 		}
-		return nil, fmt.Errorf("opponent not found")
+		return nil, errs.New(errs.CodeOpponentLeft, "opponent not found")
 	}
 	if gs.PlayerO != nil && gs.PlayerO.SessionID == sessionID {
 		if gs.PlayerX != nil {
 			return gs.PlayerX, nil
 		}
-		return nil, fmt.Errorf("opponent not found")
+		return nil, errs.New(errs.CodeOpponentLeft, "opponent not found")
 	}
-	return nil, fmt.Errorf("player not in this game")
+	return nil, errs.New(errs.CodeNotInGame, "player not in this game")
 }
 
 // IsPlayerTurn checks if it's the given player's turn
@@ -218,6 +453,18 @@ func (gs *GameSession) GetBothPlayerSessionIDs() []string {
 	return sessionIDs
 }
 
+func (gs *GameSession) GetStatus() GameSessionStatus {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.Status
+}
+
+func (gs *GameSession) GetEndedAt() time.Time {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.EndedAt
+}
+
 func (gs *GameSession) IsFull() bool {
 	gs.mu.RLock()
 	defer gs.mu.RUnlock()
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/game"
+)
+
+// GameEndNotifier reports games that end outside of a player's move, like
+// a player running out of time, to both players.
+type GameEndNotifier struct {
+	sessionManager *SessionManager
+	sender         *ResponseSender
+}
+
+func NewGameEndNotifier(sessionManager *SessionManager, sender *ResponseSender) *GameEndNotifier {
+	return &GameEndNotifier{
+		sessionManager: sessionManager,
+		sender:         sender,
+	}
+}
+
+// FlagFall tells both players that the player to move ran out of time and
+// moves them back to the lobby.
+func (n *GameEndNotifier) FlagFall(gameSession *game.GameSession) {
+	log.Printf("Player of game %s ran out of time", gameSession.Id)
+
+	sessionIDs := gameSession.GetBothPlayerSessionIDs()
+	n.sessionManager.ReturnToLobby(sessionIDs)
+
+	response := gameEndResponse(gameSession)
+	if err := n.sender.Broadcast(response.Recipients, response); err != nil {
+		log.Printf("Failed to notify players about timed out game %s: %v", gameSession.Id, err)
+	}
+}
+
+// gameEndResponse tells both players of a finished game how it ended.
+func gameEndResponse(gameSession *game.GameSession) *HandlerResponse {
+	return &HandlerResponse{
+		Broadcast:   true,
+		Recipients:  gameSession.GetBothPlayerSessionIDs(),
+		MessageType: core.GAME_END,
+		Payload:     NewGameEndPayload(gameSession),
+	}
+}
@@ -1,25 +1,51 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/errs"
 	"github.com/narik41/tictactoe-server/internal/game"
 )
 
+// GameRetention says how long games are kept around before
+// CleanupCompletedGames removes them.
+type GameRetention struct {
+	Completed time.Duration // after a game ended normally, long enough for a rematch
+	Abandoned time.Duration // after a game was abandoned
+	MaxAge    time.Duration // after a game was created, unless it is still in progress
+}
+
 type GameSessionManager struct {
 	sessions        map[string]*game.GameSession // gameID -> GameSession
 	playerToSession map[string]string            // playerSessionID -> gameID
+	timeControl     game.TimeControl
+	retention       GameRetention
+	onFlagFall      func(*game.GameSession)
+	playerPresent   func(sessionID string) bool
+	orphaned        map[string]bool // games in progress found without players by the last AbandonOrphanedGames
+	draining        atomic.Bool     // set once the server shuts down, no rematches start after it
 	mu              sync.RWMutex
 }
 
-func NewGameSessionManager() *GameSessionManager {
+// NewGameSessionManager creates games played under timeControl and keeps
+// them for as long as retention allows. onFlagFall is called when a player
+// of a timed game runs out of time. playerPresent reports whether a player
+// session is still connected or held for a resume; games in progress
+// without any such player are abandoned by the cleanup.
+func NewGameSessionManager(timeControl game.TimeControl, retention GameRetention, onFlagFall func(*game.GameSession), playerPresent func(sessionID string) bool) *GameSessionManager {
 	return &GameSessionManager{
 		sessions:        make(map[string]*game.GameSession),
 		playerToSession: make(map[string]string),
+		timeControl:     timeControl,
+		retention:       retention,
+		onFlagFall:      onFlagFall,
+		playerPresent:   playerPresent,
 	}
 }
 
@@ -28,7 +54,8 @@ func (gsm *GameSessionManager) CreateSession() *game.GameSession {
 	defer gsm.mu.Unlock()
 
 	gameID := core.UUID("game")
-	session := game.NewGameSession(gameID)
+	session := game.NewGameSession(gameID, gsm.timeControl)
+	session.OnFlagFall = gsm.onFlagFall
 	gsm.sessions[gameID] = session
 
 	log.Printf("Created game session: %s", gameID)
@@ -41,7 +68,7 @@ func (gsm *GameSessionManager) GetSession(gameID string) (*game.GameSession, err
 
 	session, exists := gsm.sessions[gameID]
 	if !exists {
-		return nil, fmt.Errorf("game session not found")
+		return nil, errs.New(errs.CodeGameNotFound, "game session not found")
 	}
 	return session, nil
 }
@@ -52,12 +79,12 @@ func (gsm *GameSessionManager) GetSessionByPlayer(playerSessionID string) (*game
 
 	gameID, exists := gsm.playerToSession[playerSessionID]
 	if !exists {
-		return nil, fmt.Errorf("player not in any game session")
+		return nil, errs.New(errs.CodeNotInGame, "player not in any game session")
 	}
 
 	session, exists := gsm.sessions[gameID]
 	if !exists {
-		return nil, fmt.Errorf("game session not found")
+		return nil, errs.New(errs.CodeGameNotFound, "game session not found")
 	}
 
 	return session, nil
@@ -69,7 +96,7 @@ func (gsm *GameSessionManager) AddPlayerToSession(gameID, playerSessionID, usern
 
 	session, exists := gsm.sessions[gameID]
 	if !exists {
-		return fmt.Errorf("game session not found")
+		return errs.New(errs.CodeGameNotFound, "game session not found")
 	}
 
 	if existingGameID, inGame := gsm.playerToSession[playerSessionID]; inGame {
@@ -91,12 +118,12 @@ func (gsm *GameSessionManager) RemovePlayerFromSession(playerSessionID string) e
 
 	gameID, exists := gsm.playerToSession[playerSessionID]
 	if !exists {
-		return fmt.Errorf("player not in any game session")
+		return errs.New(errs.CodeNotInGame, "player not in any game session")
 	}
 
 	session, exists := gsm.sessions[gameID]
 	if !exists {
-		return fmt.Errorf("game session not found")
+		return errs.New(errs.CodeGameNotFound, "game session not found")
 	}
 
 	// Remove player from session
@@ -117,6 +144,86 @@ func (gsm *GameSessionManager) RemovePlayerFromSession(playerSessionID string) e
 	return nil
 }
 
+// TransferPlayer moves a player's seat in a game in progress from one
+// connection session to another and returns that game.
+func (gsm *GameSessionManager) TransferPlayer(oldSessionID, newSessionID string) (*game.GameSession, error) {
+	gsm.mu.Lock()
+	defer gsm.mu.Unlock()
+
+	gameID, exists := gsm.playerToSession[oldSessionID]
+	if !exists {
+		return nil, errs.New(errs.CodeNotInGame, "player not in any game session")
+	}
+
+	session, exists := gsm.sessions[gameID]
+	if !exists {
+		return nil, errs.New(errs.CodeGameNotFound, "game session not found")
+	}
+
+	if session.GetStatus() != game.SessionInProgress {
+		return nil, errs.New(errs.CodeGameNotInProgress, "game is not in progress")
+	}
+
+	if err := session.ReplacePlayer(oldSessionID, newSessionID); err != nil {
+		return nil, err
+	}
+
+	delete(gsm.playerToSession, oldSessionID)
+	gsm.playerToSession[newSessionID] = gameID
+	log.Printf("Transferred seat in game %s from %s to %s", gameID, oldSessionID, newSessionID)
+	return session, nil
+}
+
+// Drain stops rematches from starting while the server waits for the games
+// in progress to finish.
+func (gsm *GameSessionManager) Drain() {
+	gsm.draining.Store(true)
+}
+
+// CreateRematch replaces a finished game with a new one between the same
+// players, with their symbols swapped. It fails once Drain was called.
+func (gsm *GameSessionManager) CreateRematch(gameID string) (*game.GameSession, error) {
+	gsm.mu.Lock()
+	defer gsm.mu.Unlock()
+
+	if gsm.draining.Load() {
+		return nil, errs.New(errs.CodeShuttingDown, "server is shutting down, no new games start")
+	}
+
+	previous, exists := gsm.sessions[gameID]
+	if !exists {
+		return nil, errs.New(errs.CodeGameNotFound, "game session not found")
+	}
+
+	if previous.GetStatus() != game.SessionCompleted {
+		return nil, errs.New(errs.CodeGameNotFinished, "game is not finished")
+	}
+
+	playerX, playerO := previous.PlayerX, previous.PlayerO
+	if playerX == nil || playerO == nil {
+		return nil, errs.New(errs.CodeOpponentLeft, "both players must be present")
+	}
+
+	gsm.removeSession(gameID)
+
+	rematchID := core.UUID("game")
+	rematch := game.NewGameSession(rematchID, gsm.timeControl)
+	rematch.OnFlagFall = gsm.onFlagFall
+	gsm.sessions[rematchID] = rematch
+
+	// the first player added plays X
+	for _, player := range []*game.PlayerInfo{playerO, playerX} {
+		if err := rematch.AddPlayer(player.SessionID, player.Username); err != nil {
+			gsm.removeSession(rematchID)
+			return nil, err
+		}
+		gsm.playerToSession[player.SessionID] = rematchID
+	}
+
+	log.Printf("Created rematch %s of game %s", rematchID, gameID)
+	return rematch, nil
+}
+
 func (gsm *GameSessionManager) RemoveSession(gameID string) error {
 	gsm.mu.Lock()
 	defer gsm.mu.Unlock()
@@ -127,7 +234,7 @@ func (gsm *GameSessionManager) RemoveSession(gameID string) error {
 func (gsm *GameSessionManager) removeSession(gameID string) error {
 	session, exists := gsm.sessions[gameID]
 	if !exists {
-		return fmt.Errorf("game session not found")
+		return errs.New(errs.CodeGameNotFound, "game session not found")
 	}
 
 	// Remove player mappings
@@ -162,6 +269,20 @@ func (gsm *GameSessionManager) GetSessionCount() int {
 	return len(gsm.sessions)
 }
 
+// GetInProgressCount returns the number of games that are still being played.
+func (gsm *GameSessionManager) GetInProgressCount() int {
+	gsm.mu.RLock()
+	defer gsm.mu.RUnlock()
+
+	count := 0
+	for _, session := range gsm.sessions {
+		if session.GetStatus() == game.SessionInProgress {
+			count++
+		}
+	}
+	return count
+}
+
 func (gsm *GameSessionManager) IsPlayerInGame(playerSessionID string) bool {
 	gsm.mu.RLock()
 	defer gsm.mu.RUnlock()
@@ -170,7 +291,55 @@ func (gsm *GameSessionManager) IsPlayerInGame(playerSessionID string) bool {
 	return exists
 }
 
-func (gsm *GameSessionManager) CleanupCompletedGames(maxAge time.Duration) int {
+// AbandonOrphanedGames ends the games in progress whose players are both
+// gone, neither connected nor held for a resume. No one is left to finish
+// them, and a shutdown would wait for them until its deadline. A game is
+// only abandoned when it was found without players by the previous call
+// too, so a player on its way from connected to held is not taken for
+// gone. It returns the number of games abandoned; they are removed like
+// any other abandoned game.
+func (gsm *GameSessionManager) AbandonOrphanedGames() int {
+	// the players are looked up without holding the lock; a player that is
+	// gone does not come back to the game
+	orphaned := make(map[string]bool)
+	var candidates []*game.GameSession
+	for _, session := range gsm.GetAllActiveSessions() {
+		if session.GetStatus() != game.SessionInProgress || gsm.hasPlayerPresent(session) {
+			continue
+		}
+		orphaned[session.Id] = true
+		candidates = append(candidates, session)
+	}
+
+	gsm.mu.Lock()
+	previous := gsm.orphaned
+	gsm.orphaned = orphaned
+	gsm.mu.Unlock()
+
+	abandoned := 0
+	for _, session := range candidates {
+		if !previous[session.Id] {
+			continue
+		}
+		session.Abandon()
+		abandoned++
+		log.Printf("Abandoned game %s, both players are gone", session.Id)
+	}
+	return abandoned
+}
+
+func (gsm *GameSessionManager) hasPlayerPresent(session *game.GameSession) bool {
+	for _, sessionID := range session.GetBothPlayerSessionIDs() {
+		if gsm.playerPresent(sessionID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (gsm *GameSessionManager) CleanupCompletedGames() int {
+	gsm.AbandonOrphanedGames()
+
 	gsm.mu.Lock()
 	defer gsm.mu.Unlock()
 
@@ -179,20 +348,25 @@ func (gsm *GameSessionManager) CleanupCompletedGames(maxAge time.Duration) int {
 
 	for gameID, session := range gsm.sessions {
 		shouldRemove := false
+		status := session.GetStatus()
+		endedAt := session.GetEndedAt()
 
-		if session.Status == game.SessionCompleted {
-			if !session.EndedAt.IsZero() && now.Sub(session.EndedAt) > 5*time.Minute {
+		if status == game.SessionCompleted {
+			if !endedAt.IsZero() && now.Sub(endedAt) > gsm.retention.Completed {
 				shouldRemove = true
 			}
 		}
 
-		if session.Status == game.SessionAbandoned {
-			if !session.EndedAt.IsZero() && now.Sub(session.EndedAt) > 1*time.Minute {
+		if status == game.SessionAbandoned {
+			if !endedAt.IsZero() && now.Sub(endedAt) > gsm.retention.Abandoned {
 				shouldRemove = true
 			}
 		}
 
-		if now.Sub(session.CreatedAt) > maxAge {
+		// a game in progress ends through its players or its clock, or is
+		// abandoned above once both are gone; removing it would leave the
+		// players seated in a game that is gone
+		if status != game.SessionInProgress && now.Sub(session.CreatedAt) > gsm.retention.MaxAge {
 			shouldRemove = true
 		}
 
@@ -208,3 +382,19 @@ func (gsm *GameSessionManager) CleanupCompletedGames(maxAge time.Duration) int {
 
 	return removed
 }
+
+// CleanupLoop calls CleanupCompletedGames every interval until ctx is
+// cancelled.
+func (gsm *GameSessionManager) CleanupLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			gsm.CleanupCompletedGames()
+		}
+	}
+}
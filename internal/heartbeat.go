@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"log"
+	"time"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+)
+
+// Heartbeat configures how the server tells live clients from dead ones.
+type Heartbeat struct {
+	Interval    time.Duration // how often every client is sent a PING; zero disables it
+	IdleTimeout time.Duration // how long a client may stay silent before it is dropped; zero disables it
+}
+
+// heartbeatLoop pings the client until the session is closed. The client's
+// PONG counts as activity and keeps the read deadline from expiring.
+func (s *Session) heartbeatLoop(sender *ResponseSender, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			if err := sender.Send(s, &HandlerResponse{MessageType: PING}); err != nil {
+				log.Printf("Heartbeat to session %s failed: %v", s.GetId(), err)
+				return
+			}
+		}
+	}
+}
+
+// PingHandler answers a client's PING with a PONG.
+type PingHandler struct{}
+
+func NewPingHandler() PingHandler {
+	return PingHandler{}
+}
+
+func (a PingHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	return &HandlerResponse{
+		MessageType: PONG,
+	}, nil
+}
+
+func (a PingHandler) RequiredStates() []SessionState {
+	return nil
+}
+
+// PongHandler accepts the client's answer to a heartbeat. Receiving it is
+// all that matters, so there is no response.
+type PongHandler struct{}
+
+func NewPongHandler() PongHandler {
+	return PongHandler{}
+}
+
+func (a PongHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	return nil, nil
+}
+
+func (a PongHandler) RequiredStates() []SessionState {
+	return nil
+}
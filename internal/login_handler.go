@@ -1,63 +1,183 @@
 package internal
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
 	"github.com/narik41/tictactoe-server/internal/repo"
 )
 
 type LoginHandler struct {
-	userRepo       repo.UserRepo
-	queue          *SessionQueue
-	sessionManager *SessionManager
+	userRepo           repo.UserRepo
+	queue              *SessionQueue
+	sessionManager     *SessionManager
+	gameSessionManager *GameSessionManager
+	sender             *ResponseSender
+	limiter            *LoginLimiter
 }
 
-func NewLoginHandler(userRepo repo.UserRepo, queue *SessionQueue, sessionManager *SessionManager) LoginHandler {
+func NewLoginHandler(userRepo repo.UserRepo, queue *SessionQueue, sessionManager *SessionManager, gameSessionManager *GameSessionManager, sender *ResponseSender, limiter *LoginLimiter) LoginHandler {
 	return LoginHandler{
-		userRepo:       userRepo,
-		queue:          queue,
-		sessionManager: sessionManager,
+		userRepo:           userRepo,
+		queue:              queue,
+		sessionManager:     sessionManager,
+		gameSessionManager: gameSessionManager,
+		sender:             sender,
+		limiter:            limiter,
 	}
 }
 
 func (a LoginHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
 	log.Println("Handling the auth request.")
-	jsonBytes, err := json.Marshal(msg.Payload)
-	if err != nil {
+	var loginPayload core.Version1MessageLoginPayload
+	if err := decodePayload(msg, &loginPayload); err != nil {
 		return nil, err
 	}
 
-	var loginPayload core.Version1MessageLoginPayload
-	if err := json.Unmarshal(jsonBytes, &loginPayload); err != nil {
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+	addr := clientSession.Client.Conn.RemoteAddr()
+	if !a.limiter.Allow(loginPayload.Username, addr) {
+		log.Printf("Too many failed logins for user %q or from %s", loginPayload.Username, addr)
+		return loginFailed(errs.CodeTooManyAttempts, "too many failed attempts, try again later"), nil
+	}
+
+	user, err := a.userRepo.GetByUsername(loginPayload.Username)
+	if err != nil && !errors.Is(err, repo.ErrUserNotFound) {
 		return nil, err
 	}
 
-	isExists := a.userRepo.GetByUsername(loginPayload.Username)
-	if !isExists {
-		return nil, fmt.Errorf("user not found")
+	// an unknown user costs a password check too, so the response time does
+	// not tell whether the account exists
+	var authenticated bool
+	if user != nil {
+		authenticated = user.CheckPassword(loginPayload.Password)
+	} else {
+		repo.CheckDummyPassword(loginPayload.Password)
+	}
+	if !authenticated {
+		a.limiter.Fail(loginPayload.Username, addr)
+		log.Printf("Authentication failed for user %q", loginPayload.Username)
+		return loginFailed(errs.CodeAuthFailed, "invalid username or password"), nil
 	}
+	a.limiter.Succeed(user.Username)
 
+	return a.login(sessionId, user)
+}
+
+// login signs the session in as user and puts it on the matchmaking queue,
+// unless it takes over the seat of the user's previous session in a game.
+func (a LoginHandler) login(sessionId string, user *repo.User) (*HandlerResponse, error) {
 	clientSession, _ := a.sessionManager.GetSession(sessionId)
 
-	// add session to queue
-	a.queue.Enqueue(clientSession)
-	return &HandlerResponse{
-		MessageType: core.MSG_LOGIN_RESPONSE,
-		Payload: &core.Version1MessageLoginResponse{
+	resumeToken, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// the claim is the last step that can fail, so a failed login leaves
+	// the username free
+	previous, err := a.sessionManager.ClaimUsername(clientSession, user.Username, resumeToken)
+	if errors.Is(err, ErrAlreadyLoggedIn) {
+		log.Printf("Rejected duplicate login of user %s", user.Username)
+		return loginFailed(errs.CodeAlreadyLoggedIn, err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := &LoginResponsePayload{
+		Version1MessageLoginResponse: core.Version1MessageLoginResponse{
 			IsAuthenticated: true,
-			Message:         loginPayload.Username,
-			PlayerId:        loginPayload.Username,
+			Message:         user.Username,
+			PlayerId:        user.Username,
 		},
-		Broadcast: false,
+		ResumeToken: resumeToken,
+	}
+
+	if previous != nil {
+		response.GameStatePayload = a.takeOver(previous, clientSession)
+	}
+
+	if response.GameStatePayload == nil {
+		// add session to queue
+		if err := a.queue.Enqueue(clientSession); err != nil {
+			return nil, err
+		}
+	}
+
+	return &HandlerResponse{
+		MessageType: core.MSG_LOGIN_RESPONSE,
+		Payload:     response,
+		Broadcast:   false,
 	}, nil
 }
 
+// takeOver kicks the user's previous session and moves its seat in a game
+// in progress to the current session. It returns the state of that game,
+// or nil if the previous session was not playing.
+func (a LoginHandler) takeOver(previous, current *Session) *GameStatePayload {
+	a.queue.Remove(previous.Id)
+	gameSession, transferErr := a.gameSessionManager.TransferPlayer(previous.Id, current.Id)
+
+	// a held session has no connection left to kick
+	if previous.GetState() != Disconnected {
+		err := a.sender.Send(previous, &HandlerResponse{
+			MessageType: SESSION_KICKED,
+			Payload: map[string]interface{}{
+				"message": "Logged in from another connection.",
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to notify kicked session %s: %v", previous.Id, err)
+		}
+		previous.Close()
+	}
+
+	if transferErr != nil {
+		return nil
+	}
+
+	gameState, err := NewGameStatePayload(gameSession, current.Id)
+	if err != nil {
+		log.Printf("Failed to build game state for session %s: %v", current.Id, err)
+		return nil
+	}
+	if err := current.Transition(IN_GAME); err != nil {
+		log.Printf("Failed to seat session %s in game %s: %v", current.Id, gameSession.Id, err)
+		return nil
+	}
+
+	err = a.sender.SendToOpponent(gameSession, current.Id, &HandlerResponse{
+		MessageType: OPPONENT_RECONNECTED,
+		Payload: map[string]interface{}{
+			"message": "Opponent reconnected.",
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to notify opponent of session %s about reconnect: %v", current.Id, err)
+	}
+
+	return gameState
+}
+
 func (a LoginHandler) RequiredStates() []SessionState {
 	return []SessionState{
 		Guest,
 	}
 }
+
+func loginFailed(code errs.Code, message string) *HandlerResponse {
+	return &HandlerResponse{
+		MessageType: core.MSG_LOGIN_RESPONSE,
+		Payload: &LoginResponsePayload{
+			Version1MessageLoginResponse: core.Version1MessageLoginResponse{
+				IsAuthenticated: false,
+				Message:         message,
+			},
+			ErrorCode: code,
+		},
+	}
+}
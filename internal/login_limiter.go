@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// LoginLimiter caps failed password checks and registrations per username
+// and per client address, so no one can guess passwords quickly or keep
+// the server busy hashing them.
+type LoginLimiter struct {
+	maxFailures int
+	window      time.Duration
+	failures    map[string]*loginFailures // "user:" + username or "addr:" + host
+	mu          sync.Mutex
+}
+
+type loginFailures struct {
+	count int
+	since time.Time // start of the window the failures are counted in
+}
+
+// NewLoginLimiter allows maxFailures failed attempts per username and per
+// address within window. A maxFailures of zero disables the limit.
+func NewLoginLimiter(maxFailures int, window time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+// Allow reports whether an attempt to log in as username from addr may
+// check a password.
+func (l *LoginLimiter) Allow(username string, addr net.Addr) bool {
+	if l.maxFailures == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range limiterKeys(username, addr) {
+		if failures := l.current(key, now); failures != nil && failures.count >= l.maxFailures {
+			return false
+		}
+	}
+	return true
+}
+
+// Fail records a failed attempt to log in as username from addr.
+func (l *LoginLimiter) Fail(username string, addr net.Addr) {
+	if l.maxFailures == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	for _, key := range limiterKeys(username, addr) {
+		failures := l.current(key, now)
+		if failures == nil {
+			failures = &loginFailures{since: now}
+			l.failures[key] = failures
+		}
+		failures.count++
+	}
+}
+
+// Record counts an attempt from addr against the limit whatever its
+// outcome. Registrations use it, as creating an account costs a password
+// hash just like checking one.
+func (l *LoginLimiter) Record(username string, addr net.Addr) {
+	l.Fail(username, addr)
+}
+
+// Succeed forgets the failures of username after a successful login. The
+// address keeps its count, a correct guess for one account says nothing
+// about the others.
+func (l *LoginLimiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, "user:"+username)
+}
+
+// current returns the failures counted for key in the window that is still
+// open at now. The caller must hold the lock.
+func (l *LoginLimiter) current(key string, now time.Time) *loginFailures {
+	failures, exists := l.failures[key]
+	if !exists {
+		return nil
+	}
+	if now.Sub(failures.since) >= l.window {
+		delete(l.failures, key)
+		return nil
+	}
+	return failures
+}
+
+// sweep drops the counts of closed windows. The caller must hold the lock.
+func (l *LoginLimiter) sweep(now time.Time) {
+	for key, failures := range l.failures {
+		if now.Sub(failures.since) >= l.window {
+			delete(l.failures, key)
+		}
+	}
+}
+
+func limiterKeys(username string, addr net.Addr) []string {
+	keys := []string{"user:" + username}
+	if addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		keys = append(keys, "addr:"+host)
+	}
+	return keys
+}
@@ -1,21 +1,25 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
 )
 
 type MessageRouter struct {
-	handlers map[core.Version1MessageType]MessageHandler
+	handlers    map[core.Version1MessageType]MessageHandler
+	middlewares []Middleware
 }
 type HandlerResponse struct {
 	MessageType core.Version1MessageType
 	Payload     interface{}
 	Broadcast   bool
 	Recipients  []string
+	InReplyTo   string // id of the client message this responds to
 }
 
 type MessageHandler interface {
@@ -35,39 +39,71 @@ func (r *MessageRouter) RegisterHandler(msgType core.Version1MessageType, handle
 	r.handlers[msgType] = handler
 }
 
+// Use adds middlewares around every handler. The first middleware added
+// is the outermost. The check of the session's state is not one of them,
+// it always runs right before the handler. Like handlers, middlewares are
+// set up before the server starts.
+func (r *MessageRouter) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Route hands the message to its handler. A message whose id the session
+// used recently is not handled again; it is answered with the result of
+// the first copy. The recent messages belong to the logical session, so a
+// retry after a resume is recognised too.
 func (r *MessageRouter) Route(msg *decoder.DecodedMessage, session *Session) (*HandlerResponse, error) {
-	// Step 1: Get handler
+	if msg.MessageId == "" {
+		return r.route(msg, session)
+	}
+
+	// only the session's read loop routes its messages, so the window
+	// needs no lock
+	window := session.recent
+	if result, seen := window.get(msg.MessageId); seen {
+		log.Printf("Replaying result of duplicate message %s for session %s", msg.MessageId, session.Id)
+		return result.replay()
+	}
+
+	response, err := r.route(msg, session)
+	window.put(msg.MessageId, routeResult{response: response, err: err})
+	return response, err
+}
+
+func (r *MessageRouter) route(msg *decoder.DecodedMessage, session *Session) (*HandlerResponse, error) {
 	handler, exists := r.handlers[msg.MessageType]
 	if !exists {
-		return nil, fmt.Errorf("unknown message type: %s", msg.MessageType)
+		return nil, errs.Newf(errs.CodeUnknownType, "unknown message type: %s", msg.MessageType)
 	}
 
-	// Step 2: Validate session state
-	if err := r.validateSessionState(handler, session); err != nil {
-		return nil, err
+	handle := checkState(callHandler)
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handle = r.middlewares[i](handle)
 	}
 
-	// Step 3: Call handler
-	log.Printf("Routing %s for session %s", msg.MessageType, session)
-	response, err := handler.Handle(msg, session.Id)
+	return handle(&Request{
+		Message: msg,
+		Session: session,
+		Handler: handler,
+	})
+}
+
+// callHandler is the end of the middleware chain.
+func callHandler(req *Request) (*HandlerResponse, error) {
+	response, err := req.Handler.Handle(req.Message, req.Session.Id)
 	if err != nil {
 		return nil, fmt.Errorf("handler failed: %w", err)
 	}
-
 	return response, nil
 }
 
-func (r *MessageRouter) validateSessionState(handler MessageHandler, session *Session) error {
-	requiredStates := handler.RequiredStates()
-	if requiredStates == nil {
-		return nil // No state restriction
+// decodePayload converts the generic payload of the message into v.
+func decodePayload(msg *decoder.DecodedMessage, v interface{}) error {
+	jsonBytes, err := json.Marshal(msg.Payload)
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, v)
 	}
-
-	for _, allowedState := range requiredStates {
-		if session.State == allowedState {
-			return nil
-		}
+	if err != nil {
+		return errs.Newf(errs.CodeInvalidPayload, "invalid %s payload: %v", msg.MessageType, err)
 	}
-
-	return fmt.Errorf("invalid session state: %s not allowed for this operation", session.State)
+	return nil
 }
@@ -0,0 +1,32 @@
+package internal
+
+import "github.com/narik41/tictactoe-helper/core"
+
+// Message types the server speaks on top of the ones shared through
+// tictactoe-helper/core.
+const (
+	SERVER_SHUTDOWN       core.Version1MessageType = "SERVER_SHUTDOWN"       // means the server is going down
+	RESUME                core.Version1MessageType = "RESUME"                // means the client wants to resume a dropped session
+	RESUME_RESPONSE       core.Version1MessageType = "RESUME_RESPONSE"       // means the server answers a resume with the game state
+	OPPONENT_DISCONNECTED core.Version1MessageType = "OPPONENT_DISCONNECTED" // means the opponent dropped and its seat is held
+	OPPONENT_RECONNECTED  core.Version1MessageType = "OPPONENT_RECONNECTED"  // means the opponent resumed its session
+	REGISTER              core.Version1MessageType = "REGISTER"              // means the client wants to create an account
+	REGISTER_RESPONSE     core.Version1MessageType = "REGISTER_RESPONSE"     // means the server answers a registration
+	SESSION_KICKED        core.Version1MessageType = "SESSION_KICKED"        // means the user logged in on another connection
+	PING                  core.Version1MessageType = "PING"                  // means the sender checks the peer is alive
+	PONG                  core.Version1MessageType = "PONG"                  // means the answer to a PING
+	RESIGN                core.Version1MessageType = "RESIGN"                // means the player gives up the game
+	OFFER_DRAW            core.Version1MessageType = "OFFER_DRAW"            // means the player offers the opponent a draw
+	RESPOND_DRAW          core.Version1MessageType = "RESPOND_DRAW"          // means the player accepts or declines a draw offer
+	DRAW_OFFERED          core.Version1MessageType = "DRAW_OFFERED"          // means the opponent offers a draw
+	DRAW_DECLINED         core.Version1MessageType = "DRAW_DECLINED"         // means the opponent declined the draw offer
+	DRAW_OFFER_SENT       core.Version1MessageType = "DRAW_OFFER_SENT"       // means the player's draw offer was passed to the opponent
+	DRAW_DECLINE_SENT     core.Version1MessageType = "DRAW_DECLINE_SENT"     // means the player's decline was passed to the opponent
+	REMATCH               core.Version1MessageType = "REMATCH"               // means the player wants to play the last opponent again
+	DECLINE_REMATCH       core.Version1MessageType = "DECLINE_REMATCH"       // means the player refuses or withdraws a rematch
+	REMATCH_OFFERED       core.Version1MessageType = "REMATCH_OFFERED"       // means the opponent wants a rematch
+	REMATCH_REQUESTED     core.Version1MessageType = "REMATCH_REQUESTED"     // means the player's rematch request waits for the opponent
+	REMATCH_DECLINED      core.Version1MessageType = "REMATCH_DECLINED"      // means there is no rematch and the player is queued again
+	SET_FRAMING           core.Version1MessageType = "SET_FRAMING"           // means the client wants messages framed differently
+	FRAMING_CHANGED       core.Version1MessageType = "FRAMING_CHANGED"       // means the last message in the old framing, the next ones use the new one
+)
@@ -0,0 +1,56 @@
+package internal
+
+// messageWindowSize is how many of a session's most recent message ids are
+// remembered to answer retried messages.
+const messageWindowSize = 32
+
+// routeResult is what routing a message produced.
+type routeResult struct {
+	response *HandlerResponse
+	err      error
+}
+
+// messageWindow remembers the results of a session's most recent messages
+// by message id.
+type messageWindow struct {
+	ids     []string // oldest first
+	results map[string]routeResult
+}
+
+func newMessageWindow() *messageWindow {
+	return &messageWindow{
+		ids:     make([]string, 0, messageWindowSize),
+		results: make(map[string]routeResult, messageWindowSize),
+	}
+}
+
+func (w *messageWindow) get(messageId string) (routeResult, bool) {
+	result, exists := w.results[messageId]
+	return result, exists
+}
+
+func (w *messageWindow) put(messageId string, result routeResult) {
+	if _, exists := w.results[messageId]; exists {
+		return
+	}
+
+	if len(w.ids) == messageWindowSize {
+		delete(w.results, w.ids[0])
+		w.ids = w.ids[1:]
+	}
+	w.ids = append(w.ids, messageId)
+	w.results[messageId] = result
+}
+
+// replay is the answer to a retried message. A broadcast already reached
+// the other recipients, so only the sender gets it again.
+func (result routeResult) replay() (*HandlerResponse, error) {
+	if result.response == nil {
+		return nil, result.err
+	}
+
+	response := *result.response
+	response.Broadcast = false
+	response.Recipients = nil
+	return &response, nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMessageWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		put      int    // ids put, msg-0 up to msg-(put-1)
+		id       string // id looked up
+		wantSeen bool
+	}{
+		{"empty", 0, "msg-0", false},
+		{"stored", 1, "msg-0", true},
+		{"unknown id", 3, "msg-9", false},
+		{"full window keeps the oldest", messageWindowSize, "msg-0", true},
+		{"full window keeps the newest", messageWindowSize, fmt.Sprintf("msg-%d", messageWindowSize-1), true},
+		{"overflow evicts the oldest", messageWindowSize + 1, "msg-0", false},
+		{"overflow keeps the next oldest", messageWindowSize + 1, "msg-1", true},
+		{"overflow keeps the newest", messageWindowSize + 1, fmt.Sprintf("msg-%d", messageWindowSize), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window := newMessageWindow()
+			for i := 0; i < tt.put; i++ {
+				window.put(fmt.Sprintf("msg-%d", i), routeResult{response: &HandlerResponse{MessageType: PONG}})
+			}
+
+			if _, seen := window.get(tt.id); seen != tt.wantSeen {
+				t.Errorf("get(%s) seen = %v, want %v", tt.id, seen, tt.wantSeen)
+			}
+			if len(window.ids) != len(window.results) || len(window.ids) > messageWindowSize {
+				t.Errorf("window holds %d ids and %d results, want the same count of at most %d", len(window.ids), len(window.results), messageWindowSize)
+			}
+		})
+	}
+}
+
+func TestMessageWindowKeepsFirstResult(t *testing.T) {
+	window := newMessageWindow()
+	window.put("msg-1", routeResult{response: &HandlerResponse{MessageType: PONG}})
+	window.put("msg-1", routeResult{err: errors.New("second")})
+
+	result, seen := window.get("msg-1")
+	if !seen {
+		t.Fatal("msg-1 not found")
+	}
+	if result.err != nil || result.response == nil || result.response.MessageType != PONG {
+		t.Errorf("result = %+v, want the first one", result)
+	}
+	if len(window.ids) != 1 {
+		t.Errorf("window holds %d ids, want 1", len(window.ids))
+	}
+}
+
+func TestRouteResultReplay(t *testing.T) {
+	handlerErr := errors.New("handler failed")
+
+	tests := []struct {
+		name   string
+		result routeResult
+	}{
+		{"error", routeResult{err: handlerErr}},
+		{"no response", routeResult{}},
+		{"reply", routeResult{response: &HandlerResponse{MessageType: PONG}}},
+		{"broadcast", routeResult{response: &HandlerResponse{
+			MessageType: DRAW_OFFERED,
+			Broadcast:   true,
+			Recipients:  []string{"player-1", "player-2"},
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := tt.result.replay()
+			if !errors.Is(err, tt.result.err) {
+				t.Errorf("err = %v, want %v", err, tt.result.err)
+			}
+			if tt.result.response == nil {
+				if response != nil {
+					t.Errorf("response = %+v, want nil", response)
+				}
+				return
+			}
+
+			if response == tt.result.response {
+				t.Fatal("replay returned the stored response, want a copy")
+			}
+			if response.MessageType != tt.result.response.MessageType {
+				t.Errorf("message type = %s, want %s", response.MessageType, tt.result.response.MessageType)
+			}
+			// only the sender gets a replay, the other recipients already
+			// had the broadcast
+			if response.Broadcast || response.Recipients != nil {
+				t.Errorf("replay broadcasts to %v, want a reply to the sender only", response.Recipients)
+			}
+		})
+	}
+}
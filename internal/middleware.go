@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
+)
+
+// Request is a message on its way to the handler of its type.
+type Request struct {
+	Message *decoder.DecodedMessage
+	Session *Session
+	Handler MessageHandler
+}
+
+// HandleFunc handles a routed message.
+type HandleFunc func(req *Request) (*HandlerResponse, error)
+
+// Middleware wraps the handling of every routed message, e.g. to check,
+// measure or log it. It calls next to pass the message on, or returns
+// without calling it to stop the message.
+type Middleware func(next HandleFunc) HandleFunc
+
+// RecoverMiddleware turns a panicking handler into an internal error so the
+// session keeps running.
+func RecoverMiddleware(next HandleFunc) HandleFunc {
+	return func(req *Request) (response *HandlerResponse, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Handler for %s panicked for session %s: %v\n%s", req.Message.MessageType, req.Session.Id, r, debug.Stack())
+				response, err = nil, fmt.Errorf("handler panicked: %v", r)
+			}
+		}()
+		return next(req)
+	}
+}
+
+// LoggingMiddleware logs every routed message with its outcome.
+func LoggingMiddleware(next HandleFunc) HandleFunc {
+	return func(req *Request) (*HandlerResponse, error) {
+		log.Printf("Routing %s for session %s", req.Message.MessageType, req.Session.Id)
+		start := time.Now()
+
+		response, err := next(req)
+		if err != nil {
+			log.Printf("Handling %s for session %s failed after %s: %v", req.Message.MessageType, req.Session.Id, time.Since(start), err)
+		}
+		return response, err
+	}
+}
+
+// checkState stops messages the handler does not accept in the session's
+// current state. The router puts it in front of every handler, so no
+// router can be set up without it.
+func checkState(next HandleFunc) HandleFunc {
+	return func(req *Request) (*HandlerResponse, error) {
+		requiredStates := req.Handler.RequiredStates()
+		if requiredStates == nil {
+			return next(req) // No state restriction
+		}
+
+		state := req.Session.GetState()
+		for _, allowedState := range requiredStates {
+			if state == allowedState {
+				return next(req)
+			}
+		}
+
+		return nil, errs.Newf(errs.CodeInvalidState, "invalid session state: %s not allowed for this operation", state)
+	}
+}
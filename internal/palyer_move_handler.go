@@ -1,76 +1,76 @@
 package internal
 
 import (
-	"encoding/json"
 	"log"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
 )
 
 type PlayerMoveHandler struct {
 	gameSessionManager *GameSessionManager
+	sessionManager     *SessionManager
 }
 
-func NewPlayerMoveHandler(gameSessionManager *GameSessionManager) PlayerMoveHandler {
+func NewPlayerMoveHandler(gameSessionManager *GameSessionManager, sessionManager *SessionManager) PlayerMoveHandler {
 	return PlayerMoveHandler{
 		gameSessionManager: gameSessionManager,
+		sessionManager:     sessionManager,
 	}
 }
 
 func (a PlayerMoveHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
 	log.Println("PlayerMoveHandler.Handle")
-	jsonBytes, err := json.Marshal(msg.Payload)
-	if err != nil {
+	var movePayload core.Version1PositionMoveRequestPayload
+	if err := decodePayload(msg, &movePayload); err != nil {
 		return nil, err
 	}
 
-	var loginPayload core.Version1PositionMoveRequestPayload
-	if err := json.Unmarshal(jsonBytes, &loginPayload); err != nil {
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
 		return nil, err
 	}
 
-	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	// the symbol is assigned by the server, a client may only repeat it
+	playerInfo, err := gameSession.GetPlayerInfo(sessionId)
 	if err != nil {
 		return nil, err
 	}
+	if movePayload.Symbol != "" && movePayload.Symbol != string(playerInfo.Symbol) {
+		return nil, errs.Newf(errs.CodeSymbolMismatch, "you play %s, not %s", playerInfo.Symbol, movePayload.Symbol)
+	}
 
-	err = gameSession.MakeMove(sessionId, loginPayload.Position)
+	move, err := gameSession.MakeMove(sessionId, movePayload.Position)
 	if err != nil {
 		return nil, err
 	}
 
 	if gameSession.Game.IsGameEnd() {
-		return &HandlerResponse{
-			Broadcast: true,
-			Recipients: []string{
-				gameSession.PlayerO.SessionID, gameSession.PlayerX.SessionID,
-			},
-			MessageType: core.GAME_END,
-			Payload: &core.Version1GameEndPayload{
-				Result: "",
-				Winner: string(gameSession.Game.GetWinnerSymbol()),
-			},
-		}, nil
+		a.sessionManager.ReturnToLobby(gameSession.GetBothPlayerSessionIDs())
+		return gameEndResponse(gameSession), nil
 	}
 
 	return &HandlerResponse{
-		Broadcast: true,
-		Recipients: []string{
-			gameSession.PlayerO.SessionID, gameSession.PlayerX.SessionID,
-		},
+		Broadcast:   true,
+		Recipients:  gameSession.GetBothPlayerSessionIDs(),
 		MessageType: core.PLAYER_MOVE_RESPONSE,
-		Payload: &core.Version1PositionMovedResponsePayload{
-			MovedByUser:     loginPayload.Symbol,
-			MovedToPosition: loginPayload.Position,
-			TurnSymbol:      string(gameSession.Game.GetCurrentTurn()),
+		Payload: &PlayerMoveResponsePayload{
+			Version1PositionMovedResponsePayload: core.Version1PositionMovedResponsePayload{
+				MovedByUser:     string(move.Symbol),
+				MovedToPosition: move.Position,
+				TurnSymbol:      string(move.NextTurn),
+			},
+			MovedByUsername: move.Username,
+			MoveNumber:      move.Number,
+			Board:           move.Board,
+			Clock:           NewClockPayload(gameSession),
 		},
 	}, nil
 }
 
 func (a PlayerMoveHandler) RequiredStates() []SessionState {
 	return []SessionState{
-		LoggedIn,
 		IN_GAME,
 	}
 }
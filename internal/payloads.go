@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/game"
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+// LoginResponsePayload extends the shared login response with the token a
+// client presents in a RESUME message after losing its connection. When
+// the login takes over a seat in a running game, the game state is
+// included. A failed login carries the error code.
+type LoginResponsePayload struct {
+	core.Version1MessageLoginResponse
+	ResumeToken string    `json:"resume_token,omitempty"`
+	ErrorCode   errs.Code `json:"error_code,omitempty"`
+	*GameStatePayload
+}
+
+type ResumePayload struct {
+	ResumeToken string `json:"resume_token"`
+}
+
+type ResumeResponsePayload struct {
+	Resumed     bool      `json:"resumed"`
+	Message     string    `json:"message,omitempty"`
+	PlayerId    string    `json:"player_id,omitempty"`
+	ResumeToken string    `json:"resume_token,omitempty"`
+	ErrorCode   errs.Code `json:"error_code,omitempty"`
+	*GameStatePayload
+}
+
+// GameStatePayload is everything a client needs to redraw a game it joins
+// in the middle.
+type GameStatePayload struct {
+	GameId     string        `json:"game_id"`
+	YourSymbol string        `json:"your_symbol"`
+	Board      []string      `json:"board"`
+	TurnSymbol string        `json:"turn_symbol"`
+	YourTurn   bool          `json:"your_turn"`
+	Clock      *ClockPayload `json:"clock,omitempty"`
+}
+
+func NewGameStatePayload(gameSession *game.GameSession, sessionID string) (*GameStatePayload, error) {
+	playerInfo, err := gameSession.GetPlayerInfo(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GameStatePayload{
+		GameId:     gameSession.Id,
+		YourSymbol: string(playerInfo.Symbol),
+		Board:      gameSession.Game.GetBoard().ToArray(),
+		TurnSymbol: string(gameSession.Game.GetCurrentTurn()),
+		YourTurn:   gameSession.Game.GetCurrentTurn() == playerInfo.Symbol,
+		Clock:      NewClockPayload(gameSession),
+	}, nil
+}
+
+// GameEndPayload extends the shared game end, whose Result carries the
+// reason the game ended, with what a client needs to show the outcome.
+// Status is WON or DRAW.
+type GameEndPayload struct {
+	core.Version1GameEndPayload
+	Status         string   `json:"status"`
+	WinnerUsername string   `json:"winner_username,omitempty"`
+	WinningLine    []int    `json:"winning_line,omitempty"`
+	Board          []string `json:"board"`
+}
+
+func NewGameEndPayload(gameSession *game.GameSession) *GameEndPayload {
+	winner := gameSession.Game.GetWinnerSymbol()
+	payload := &GameEndPayload{
+		Version1GameEndPayload: core.Version1GameEndPayload{
+			GameId: gameSession.Id,
+			Result: string(gameSession.EndReason),
+			Winner: string(winner),
+		},
+		Status:      string(gameSession.Game.GetStatus()),
+		WinningLine: gameSession.Game.GetWinningLine(),
+		Board:       gameSession.Game.GetBoard().ToArray(),
+	}
+	if winnerInfo, err := gameSession.GetPlayerBySymbol(winner); err == nil {
+		payload.WinnerUsername = winnerInfo.Username
+	}
+	return payload
+}
+
+// GameStartPayload extends the shared game start with the clock of a timed
+// game.
+type GameStartPayload struct {
+	core.Version1GameStartPayload
+	Clock *ClockPayload `json:"clock,omitempty"`
+}
+
+// PlayerMoveResponsePayload extends the shared move response with the rest
+// of the server's view of the move and the clock of a timed game.
+type PlayerMoveResponsePayload struct {
+	core.Version1PositionMovedResponsePayload
+	MovedByUsername string        `json:"moved_by_username"`
+	MoveNumber      int           `json:"move_number"`
+	Board           []string      `json:"board"`
+	Clock           *ClockPayload `json:"clock,omitempty"`
+}
+
+// ClockPayload is the thinking time left in a timed game, in milliseconds.
+// Remaining is keyed by symbol and only set when the players have a total
+// clock.
+type ClockPayload struct {
+	TurnRemainingMs int64            `json:"turn_remaining_ms"`
+	RemainingMs     map[string]int64 `json:"remaining_ms,omitempty"`
+}
+
+// NewClockPayload returns the clock of the game, or nil for an untimed game.
+func NewClockPayload(gameSession *game.GameSession) *ClockPayload {
+	clock, timed := gameSession.GetClock()
+	if !timed {
+		return nil
+	}
+
+	payload := &ClockPayload{
+		TurnRemainingMs: clock.TurnRemaining.Milliseconds(),
+	}
+	if clock.Remaining != nil {
+		payload.RemainingMs = make(map[string]int64, len(clock.Remaining))
+		for symbol, remaining := range clock.Remaining {
+			payload.RemainingMs[string(symbol)] = remaining.Milliseconds()
+		}
+	}
+	return payload
+}
+
+type RegisterPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Login    bool   `json:"login"` // log the new account straight in
+}
+
+type RegisterResponsePayload struct {
+	Registered bool      `json:"registered"`
+	Message    string    `json:"message,omitempty"`
+	ErrorCode  errs.Code `json:"error_code,omitempty"`
+}
+
+type RespondDrawPayload struct {
+	Accept bool `json:"accept"`
+}
+
+type FramingPayload struct {
+	Framing transport.Framing `json:"framing"`
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"regexp"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/repo"
+)
+
+const (
+	minPasswordLength = 6
+	maxPasswordLength = 128
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,20}$`)
+
+// RegisterHandler creates accounts. Every registration costs a password
+// hash, so it counts against the same limiter as failed logins, and a
+// connection may create one account only.
+type RegisterHandler struct {
+	userRepo       repo.UserRepo
+	sessionManager *SessionManager
+	loginHandler   LoginHandler
+	limiter        *LoginLimiter
+}
+
+func NewRegisterHandler(userRepo repo.UserRepo, sessionManager *SessionManager, loginHandler LoginHandler, limiter *LoginLimiter) RegisterHandler {
+	return RegisterHandler{
+		userRepo:       userRepo,
+		sessionManager: sessionManager,
+		loginHandler:   loginHandler,
+		limiter:        limiter,
+	}
+}
+
+func (a RegisterHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the register request.")
+	var registerPayload RegisterPayload
+	if err := decodePayload(msg, &registerPayload); err != nil {
+		return nil, err
+	}
+
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+	if clientSession.registered {
+		return registerFailed(errs.CodeAlreadyRegistered, "this connection already registered an account"), nil
+	}
+
+	if err := validateRegistration(registerPayload); err != nil {
+		return registerFailed(err.Code, err.Message), nil
+	}
+
+	addr := clientSession.Client.Conn.RemoteAddr()
+	if !a.limiter.Allow(registerPayload.Username, addr) {
+		log.Printf("Too many attempts for user %q or from %s", registerPayload.Username, addr)
+		return registerFailed(errs.CodeTooManyAttempts, "too many attempts, try again later"), nil
+	}
+
+	// a taken username is answered before hashing the password
+	_, err := a.userRepo.GetByUsername(registerPayload.Username)
+	if err == nil {
+		return registerFailed(errs.CodeUsernameTaken, "username is already taken"), nil
+	}
+	if !errors.Is(err, repo.ErrUserNotFound) {
+		return nil, err
+	}
+
+	a.limiter.Record(registerPayload.Username, addr)
+	user, err := repo.NewUser(registerPayload.Username, registerPayload.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.userRepo.Create(user); err != nil {
+		if errors.Is(err, repo.ErrUserExists) {
+			return registerFailed(errs.CodeUsernameTaken, "username is already taken"), nil
+		}
+		return nil, err
+	}
+	clientSession.registered = true
+	log.Printf("Registered user %s", user.Username)
+
+	if registerPayload.Login {
+		return a.loginHandler.login(sessionId, user)
+	}
+
+	return &HandlerResponse{
+		MessageType: REGISTER_RESPONSE,
+		Payload: &RegisterResponsePayload{
+			Registered: true,
+			Message:    user.Username,
+		},
+	}, nil
+}
+
+func (a RegisterHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		Guest,
+	}
+}
+
+func validateRegistration(payload RegisterPayload) *errs.Error {
+	if !usernamePattern.MatchString(payload.Username) {
+		return errs.New(errs.CodeInvalidUsername, "username must be 3 to 20 letters, digits or underscores")
+	}
+	if len(payload.Password) < minPasswordLength || len(payload.Password) > maxPasswordLength {
+		return errs.Newf(errs.CodeInvalidPassword, "password must be %d to %d characters long", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+func registerFailed(code errs.Code, message string) *HandlerResponse {
+	return &HandlerResponse{
+		MessageType: REGISTER_RESPONSE,
+		Payload: &RegisterResponsePayload{
+			Registered: false,
+			Message:    message,
+			ErrorCode:  code,
+		},
+	}
+}
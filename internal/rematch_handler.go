@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/game"
+)
+
+// RematchHandler asks the last opponent for another game. When both
+// players asked, a new game starts with their symbols swapped.
+type RematchHandler struct {
+	gameSessionManager *GameSessionManager
+	sessionManager     *SessionManager
+	sender             *ResponseSender
+}
+
+func NewRematchHandler(gameSessionManager *GameSessionManager, sessionManager *SessionManager, sender *ResponseSender) RematchHandler {
+	return RematchHandler{
+		gameSessionManager: gameSessionManager,
+		sessionManager:     sessionManager,
+		sender:             sender,
+	}
+}
+
+func (a RematchHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the rematch request.")
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	opponent, err := gameSession.GetOpponentInfo(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	agreed, err := gameSession.RequestRematch(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !agreed {
+		err = a.sender.SendToOpponent(gameSession, sessionId, &HandlerResponse{
+			MessageType: REMATCH_OFFERED,
+			Payload: map[string]interface{}{
+				"message": "Opponent wants a rematch.",
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to pass the rematch request of session %s on: %v", sessionId, err)
+		}
+
+		return &HandlerResponse{
+			MessageType: REMATCH_REQUESTED,
+			Payload: map[string]interface{}{
+				"message": "Rematch requested, waiting for the opponent.",
+			},
+		}, nil
+	}
+
+	opponentSession, exists := a.sessionManager.GetSession(opponent.SessionID)
+	if !exists {
+		return nil, errs.New(errs.CodeOpponentLeft, "opponent left")
+	}
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+
+	rematch, err := a.gameSessionManager.CreateRematch(gameSession.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := clientSession.Transition(IN_GAME); err != nil {
+		log.Printf("Failed to move session %s into the rematch: %v", clientSession.Id, err)
+	}
+	if err := opponentSession.Transition(IN_GAME); err != nil {
+		log.Printf("Failed to move session %s into the rematch: %v", opponentSession.Id, err)
+	}
+	rematch.Start()
+
+	log.Printf("Rematch %s started between %s and %s",
+		rematch.Id, clientSession.Username, opponentSession.Username)
+
+	// the requester's GAME_START answers its REMATCH
+	a.sender.Send(opponentSession, gameStartResponse(rematch, opponentSession.Id))
+	return gameStartResponse(rematch, clientSession.Id), nil
+}
+
+func (a RematchHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		LoggedIn,
+	}
+}
+
+// DeclineRematchHandler refuses the opponent's rematch or withdraws the
+// player's own request. Both players go back to the matchmaking queue.
+type DeclineRematchHandler struct {
+	gameSessionManager *GameSessionManager
+	sessionManager     *SessionManager
+	queue              *SessionQueue
+	sender             *ResponseSender
+}
+
+func NewDeclineRematchHandler(gameSessionManager *GameSessionManager, sessionManager *SessionManager, queue *SessionQueue, sender *ResponseSender) DeclineRematchHandler {
+	return DeclineRematchHandler{
+		gameSessionManager: gameSessionManager,
+		sessionManager:     sessionManager,
+		queue:              queue,
+		sender:             sender,
+	}
+}
+
+func (a DeclineRematchHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the rematch decline.")
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
+		// the finished game was already cleaned up, there is nobody left
+		// to decline
+		if err := a.queue.Enqueue(clientSession); err != nil {
+			return nil, err
+		}
+		return rematchDeclinedResponse(), nil
+	}
+
+	if gameSession.GetStatus() != game.SessionCompleted {
+		return nil, errs.New(errs.CodeGameNotFinished, "game is not finished")
+	}
+
+	opponent, opponentErr := gameSession.GetOpponentInfo(sessionId)
+
+	if err := a.gameSessionManager.RemoveSession(gameSession.Id); err != nil {
+		return nil, err
+	}
+
+	if opponentErr == nil {
+		if opponentSession, exists := a.sessionManager.GetSession(opponent.SessionID); exists {
+			cancelRematch(a.sender, a.queue, opponentSession, "Opponent declined the rematch.")
+		}
+	}
+
+	if err := a.queue.Enqueue(clientSession); err != nil {
+		return nil, err
+	}
+	return rematchDeclinedResponse(), nil
+}
+
+func (a DeclineRematchHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		LoggedIn,
+	}
+}
+
+// rematchDeclinedResponse confirms a DECLINE_REMATCH to the player, who
+// is on the matchmaking queue by then.
+func rematchDeclinedResponse() *HandlerResponse {
+	return &HandlerResponse{
+		MessageType: REMATCH_DECLINED,
+		Payload: map[string]interface{}{
+			"message": "No rematch, waiting for a new opponent.",
+		},
+	}
+}
+
+// cancelRematch tells a player of a finished game that there will be no
+// rematch and puts it back on the matchmaking queue.
+func cancelRematch(sender *ResponseSender, queue *SessionQueue, session *Session, message string) {
+	if session.GetState() != LoggedIn {
+		return
+	}
+
+	err := sender.Send(session, &HandlerResponse{
+		MessageType: REMATCH_DECLINED,
+		Payload: map[string]interface{}{
+			"message": message,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to notify session %s about the cancelled rematch: %v", session.Id, err)
+	}
+
+	if err := queue.Enqueue(session); err != nil {
+		log.Printf("Failed to queue session %s after the cancelled rematch: %v", session.Id, err)
+	}
+}
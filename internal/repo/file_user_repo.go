@@ -0,0 +1,136 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileUserRepo keeps the users in a JSON file so they survive restarts.
+// The whole file is rewritten on every change; it is written to a
+// temporary file first and renamed over the old one, so a crash never
+// leaves a half written store behind.
+type FileUserRepo struct {
+	path  string
+	users map[string]*User
+	mu    sync.RWMutex
+}
+
+type userFile struct {
+	Users map[string]*User `json:"users"`
+}
+
+// NewFileUserRepo opens the store at path, creating an empty one if the
+// file does not exist yet.
+func NewFileUserRepo(path string) (UserRepo, error) {
+	repo := &FileUserRepo{
+		path:  path,
+		users: make(map[string]*User),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("User store %s not found, starting with an empty one", path)
+		return repo, repo.save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user store: %w", err)
+	}
+
+	var file userFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse user store %s: %w", path, err)
+	}
+	if file.Users != nil {
+		repo.users = file.Users
+	}
+
+	log.Printf("Loaded %d users from %s", len(repo.users), path)
+	return repo, nil
+}
+
+func (a *FileUserRepo) GetByUsername(username string) (*User, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	user, exists := a.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	userCopy := *user
+	return &userCopy, nil
+}
+
+func (a *FileUserRepo) Create(user *User) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.users[user.Username]; exists {
+		return ErrUserExists
+	}
+
+	userCopy := *user
+	a.users[user.Username] = &userCopy
+	if err := a.save(); err != nil {
+		delete(a.users, user.Username)
+		return err
+	}
+	return nil
+}
+
+func (a *FileUserRepo) Update(user *User) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous, exists := a.users[user.Username]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	userCopy := *user
+	a.users[user.Username] = &userCopy
+	if err := a.save(); err != nil {
+		a.users[user.Username] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the users to disk. The caller must hold the lock.
+func (a *FileUserRepo) save() error {
+	data, err := json.MarshalIndent(userFile{Users: a.users}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode user store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	saltLength     = 16
+	hashLength     = 32
+	hashIterations = 600000
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // hex encoded PBKDF2-SHA256 of the password
+	Salt         string `json:"salt"`          // hex encoded random salt
+}
+
+// NewUser creates a user whose password is stored as a salted hash.
+func NewUser(username, password string) (*User, error) {
+	user := &User{Username: username}
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetPassword replaces the user's password hash with one for password,
+// using a fresh salt.
+func (u *User) SetPassword(password string) error {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	u.Salt = hex.EncodeToString(salt)
+	u.PasswordHash = hex.EncodeToString(hash)
+	return nil
+}
+
+// CheckPassword reports whether password matches the stored hash.
+func (u *User) CheckPassword(password string) bool {
+	salt, err := hex.DecodeString(u.Salt)
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(u.PasswordHash)
+	if err != nil {
+		return false
+	}
+
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, expected) == 1
+}
+
+// dummyUser is checked against when there is no user with the given name,
+// so that a failed login costs the same whether the account exists or not.
+// It is made up front, so the first unknown user is not slower either.
+var dummyUser = func() *User {
+	user, err := NewUser("", "dummy password")
+	if err != nil {
+		panic(err)
+	}
+	return user
+}()
+
+// CheckDummyPassword spends the time of a real password check.
+func CheckDummyPassword(password string) {
+	dummyUser.CheckPassword(password)
+}
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, hashIterations, hashLength)
+}
@@ -1,27 +1,76 @@
 package repo
 
+import (
+	"errors"
+	"sync"
+)
+
 type UserRepo interface {
-	GetByUsername(username string) bool
+	GetByUsername(username string) (*User, error)
+	Create(user *User) error
+	Update(user *User) error
 }
 
-type UserRepoImpl struct{}
+// UserRepoImpl keeps the users in memory; they are lost on restart.
+type UserRepoImpl struct {
+	users map[string]*User
+	mu    sync.RWMutex
+}
 
-func NewUserRepo() UserRepo {
-	return UserRepoImpl{}
+func NewUserRepo() (UserRepo, error) {
+	return &UserRepoImpl{users: make(map[string]*User)}, nil
 }
 
-func (a UserRepoImpl) GetByUsername(username string) bool {
-	registerUser := getRegisterUser()
-	_, exists := registerUser[username]
+func (a *UserRepoImpl) GetByUsername(username string) (*User, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	user, exists := a.users[username]
 	if !exists {
-		return false
+		return nil, ErrUserNotFound
+	}
+	userCopy := *user
+	return &userCopy, nil
+}
+
+func (a *UserRepoImpl) Create(user *User) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	userCopy := *user
+	a.users[user.Username] = &userCopy
+	return nil
+}
+
+func (a *UserRepoImpl) Update(user *User) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.users[user.Username]; !exists {
+		return ErrUserNotFound
 	}
-	return true
+	userCopy := *user
+	a.users[user.Username] = &userCopy
+	return nil
 }
 
-func getRegisterUser() map[string]string {
-	users := make(map[string]string)
-	users["narik"] = "narik"
-	users["santo"] = "santo"
-	return users
+// SeedDevUsers adds the well known accounts narik and santo, each with its
+// name as password, for local development. Accounts that exist are kept.
+func SeedDevUsers(repo UserRepo) error {
+	for username, password := range map[string]string{
+		"narik": "narik",
+		"santo": "santo",
+	} {
+		user, err := NewUser(username, password)
+		if err != nil {
+			return err
+		}
+		if err := repo.Create(user); err != nil && !errors.Is(err, ErrUserExists) {
+			return err
+		}
+	}
+	return nil
 }
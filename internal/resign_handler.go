@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+)
+
+type ResignHandler struct {
+	gameSessionManager *GameSessionManager
+	sessionManager     *SessionManager
+}
+
+func NewResignHandler(gameSessionManager *GameSessionManager, sessionManager *SessionManager) ResignHandler {
+	return ResignHandler{
+		gameSessionManager: gameSessionManager,
+		sessionManager:     sessionManager,
+	}
+}
+
+func (a ResignHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the resign request.")
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gameSession.Resign(sessionId); err != nil {
+		return nil, err
+	}
+
+	a.sessionManager.ReturnToLobby(gameSession.GetBothPlayerSessionIDs())
+	return gameEndResponse(gameSession), nil
+}
+
+func (a ResignHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		IN_GAME,
+	}
+}
@@ -1,14 +1,16 @@
 package internal
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/game"
+	"github.com/narik41/tictactoe-server/internal/transport"
 )
 
 type ResponseSender struct {
@@ -23,22 +25,58 @@ func NewResponseSender(sessionManager *SessionManager) *ResponseSender {
 
 func (rs *ResponseSender) Send(session *Session, response *HandlerResponse) error {
 
-	msgBytes, err := rs.encodeMessage(response.MessageType, response.Payload)
+	msgBytes, err := rs.encodeMessage(response.MessageType, response.Payload, response.InReplyTo)
 	if err != nil {
 		return fmt.Errorf("failed to encode: %w", err)
 	}
 
-	if err := rs.writeToConn(session.Client.Conn, msgBytes); err != nil {
+	if err := session.QueueMessage(msgBytes); err != nil {
 		return fmt.Errorf("failed to send: %w", err)
 	}
 
-	log.Printf("Sent %s to session %s", response.MessageType, session.Id)
+	log.Printf("Sent %s to session %s", response.MessageType, session.GetId())
 	return nil
 }
 
+// SendFramingSwitch sends the response as the last message in the
+// session's current framing; everything sent after it uses framing.
+func (rs *ResponseSender) SendFramingSwitch(session *Session, response *HandlerResponse, framing transport.Framing) error {
+	msgBytes, err := rs.encodeMessage(response.MessageType, response.Payload, response.InReplyTo)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %w", err)
+	}
+
+	if err := session.QueueFramingSwitch(msgBytes, framing); err != nil {
+		return fmt.Errorf("failed to send: %w", err)
+	}
+
+	log.Printf("Sent %s to session %s, switching to %s framing", response.MessageType, session.GetId(), framing)
+	return nil
+}
+
+// ReplyAll sends the response to every recipient. Only the requester's copy
+// refers to its message in InReplyTo; the id was chosen by the requester's
+// client and means nothing to the others.
+func (rs *ResponseSender) ReplyAll(requester *Session, recipientIDs []string, response *HandlerResponse) error {
+	others := make([]string, 0, len(recipientIDs))
+	for _, sessionID := range recipientIDs {
+		if sessionID != requester.Id {
+			others = append(others, sessionID)
+			continue
+		}
+		if err := rs.Send(requester, response); err != nil {
+			log.Printf("Failed to reply to session %s: %v", sessionID, err)
+		}
+	}
+
+	return rs.Broadcast(others, response)
+}
+
+// Broadcast sends the response to every recipient. A broadcast is not a
+// reply, so InReplyTo is left out.
 func (rs *ResponseSender) Broadcast(recipientIDs []string, response *HandlerResponse) error {
 
-	msgBytes, err := rs.encodeMessage(response.MessageType, response.Payload)
+	msgBytes, err := rs.encodeMessage(response.MessageType, response.Payload, "")
 	if err != nil {
 		return fmt.Errorf("failed to encode: %w", err)
 	}
@@ -52,7 +90,7 @@ func (rs *ResponseSender) Broadcast(recipientIDs []string, response *HandlerResp
 			continue
 		}
 
-		if err := rs.writeToConn(session.Client.Conn, msgBytes); err != nil {
+		if err := session.QueueMessage(msgBytes); err != nil {
 			log.Printf("Failed to broadcast to session %s: %v", sessionID, err)
 			sendErrors = append(sendErrors, err)
 			continue
@@ -68,67 +106,73 @@ func (rs *ResponseSender) Broadcast(recipientIDs []string, response *HandlerResp
 	return nil
 }
 
-func (rs *ResponseSender) SendError(session *Session, errorCode, errorMessage string) error {
-	errorPayload := &core.Version1MessagePayload{
-		MessageType: core.ERROR,
-		Payload: map[string]interface{}{
-			"code":    errorCode,
-			"message": errorMessage,
-		},
-	}
-
-	msgBytes, err := rs.encodeMessage("ERROR", errorPayload)
+// SendToOpponent sends the response to the opponent of sessionID in the
+// game session, if the opponent is connected.
+func (rs *ResponseSender) SendToOpponent(gameSession *game.GameSession, sessionID string, response *HandlerResponse) error {
+	opponent, err := gameSession.GetOpponentInfo(sessionID)
 	if err != nil {
-		return fmt.Errorf("failed to encode error: %w", err)
+		return err
 	}
 
-	if err := rs.writeToConn(session.Client.Conn, msgBytes); err != nil {
-		return fmt.Errorf("failed to send error: %w", err)
+	opponentSession, exists := rs.sessionManager.GetSession(opponent.SessionID)
+	if !exists {
+		return fmt.Errorf("opponent session %s not connected", opponent.SessionID)
 	}
 
-	log.Printf("Sent error to session %s: %s", session.Id, errorCode)
-	return nil
+	return rs.Send(opponentSession, response)
 }
 
-func (rs *ResponseSender) encodeMessage(messageType core.Version1MessageType, payload interface{}) ([]byte, error) {
-
-	v1Payload := &core.Version1MessagePayload{
-		MessageType: messageType,
-		Payload:     payload,
+// SendError reports err to the session under its code from the errs
+// catalogue. Errors without a code are logged and reported as
+// INTERNAL_ERROR without their details. messageId is the id of the message
+// that caused the error, empty if it is unknown; it goes in InReplyTo.
+func (rs *ResponseSender) SendError(session *Session, err error, messageId string) error {
+	var codedErr *errs.Error
+	if !errors.As(err, &codedErr) {
+		log.Printf("Internal error for session %s: %v", session.GetId(), err)
+		codedErr = errs.New(errs.CodeInternal, "internal server error")
 	}
 
-	msg := core.TicTacToeMessage{
-		MessageId: core.UUID("msg"),
-		Version:   "v1",
-		Timestamp: time.Now().UnixMilli(),
-		Payload:   v1Payload,
-	}
-
-	msgBytes, err := json.Marshal(msg)
+	msgBytes, err := rs.encodeMessage(core.ERROR, &core.Version1ErrorInfoPayload{
+		Code:    string(codedErr.Code),
+		Message: codedErr.Message,
+	}, messageId)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to encode error: %w", err)
 	}
 
-	msgBytes = append(msgBytes, '\n')
+	if err := session.QueueMessage(msgBytes); err != nil {
+		return fmt.Errorf("failed to send error: %w", err)
+	}
 
-	return msgBytes, nil
+	log.Printf("Sent error to session %s: %s", session.GetId(), codedErr.Code)
+	return nil
 }
 
-func (rs *ResponseSender) writeToConn(conn net.Conn, data []byte) error {
-	writer := bufio.NewWriter(conn)
+// OutboundMessage is the envelope of every message the server sends. A
+// message caused by a client message refers to it in InReplyTo, so the
+// client can match responses and errors to its requests.
+type OutboundMessage struct {
+	core.TicTacToeMessage
+	InReplyTo string `json:"inReplyTo,omitempty"`
+}
 
-	n, err := writer.Write(data)
-	if err != nil {
-		return err
-	}
+func (rs *ResponseSender) encodeMessage(messageType core.Version1MessageType, payload interface{}, inReplyTo string) ([]byte, error) {
 
-	if n != len(data) {
-		return fmt.Errorf("incomplete write: wrote %d of %d bytes", n, len(data))
+	v1Payload := &core.Version1MessagePayload{
+		MessageType: messageType,
+		Payload:     payload,
 	}
 
-	if err := writer.Flush(); err != nil {
-		return err
+	msg := OutboundMessage{
+		TicTacToeMessage: core.TicTacToeMessage{
+			MessageId: core.UUID("msg"),
+			Version:   "v1",
+			Timestamp: time.Now().UnixMilli(),
+			Payload:   v1Payload,
+		},
+		InReplyTo: inReplyTo,
 	}
 
-	return nil
+	return json.Marshal(msg)
 }
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/narik41/tictactoe-server/internal/decoder"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/game"
+)
+
+type ResumeHandler struct {
+	sessionManager     *SessionManager
+	gameSessionManager *GameSessionManager
+	queue              *SessionQueue
+	sender             *ResponseSender
+}
+
+func NewResumeHandler(sessionManager *SessionManager, gameSessionManager *GameSessionManager, queue *SessionQueue, sender *ResponseSender) ResumeHandler {
+	return ResumeHandler{
+		sessionManager:     sessionManager,
+		gameSessionManager: gameSessionManager,
+		queue:              queue,
+		sender:             sender,
+	}
+}
+
+func (a ResumeHandler) Handle(msg *decoder.DecodedMessage, sessionId string) (*HandlerResponse, error) {
+	log.Println("Handling the resume request.")
+	var resumePayload ResumePayload
+	if err := decodePayload(msg, &resumePayload); err != nil {
+		return nil, err
+	}
+
+	clientSession, _ := a.sessionManager.GetSession(sessionId)
+	if err := a.sessionManager.Resume(resumePayload.ResumeToken, clientSession); err != nil {
+		return &HandlerResponse{
+			MessageType: RESUME_RESPONSE,
+			Payload: &ResumeResponsePayload{
+				Resumed:   false,
+				Message:   err.Error(),
+				ErrorCode: errs.CodeResumeFailed,
+			},
+		}, nil
+	}
+
+	response := &ResumeResponsePayload{
+		Resumed:     true,
+		PlayerId:    clientSession.Username,
+		ResumeToken: clientSession.ResumeToken,
+	}
+
+	gameSession, err := a.gameSessionManager.GetSessionByPlayer(clientSession.Id)
+	if err != nil || gameSession.GetStatus() != game.SessionInProgress {
+		// the game ended while the player was away, so it looks for a new
+		// opponent like after a login
+		if err := clientSession.Transition(LoggedIn); err != nil {
+			return nil, err
+		}
+		if gameSession != nil {
+			a.leaveFinishedGame(clientSession, gameSession)
+		}
+		if err := a.queue.Enqueue(clientSession); err != nil {
+			return nil, err
+		}
+		response.Message = "game is over"
+		return &HandlerResponse{
+			MessageType: RESUME_RESPONSE,
+			Payload:     response,
+		}, nil
+	}
+
+	gameState, err := NewGameStatePayload(gameSession, clientSession.Id)
+	if err != nil {
+		return nil, err
+	}
+	response.GameStatePayload = gameState
+
+	err = a.sender.SendToOpponent(gameSession, clientSession.Id, &HandlerResponse{
+		MessageType: OPPONENT_RECONNECTED,
+		Payload: map[string]interface{}{
+			"message": "Opponent reconnected.",
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to notify opponent of session %s about reconnect: %v", clientSession.Id, err)
+	}
+
+	return &HandlerResponse{
+		MessageType: RESUME_RESPONSE,
+		Payload:     response,
+	}, nil
+}
+
+// leaveFinishedGame takes the resumed session out of the game that ended
+// while it was away, so it can be matched again, and releases an opponent
+// waiting for a rematch.
+func (a ResumeHandler) leaveFinishedGame(clientSession *Session, gameSession *game.GameSession) {
+	opponent, opponentErr := gameSession.GetOpponentInfo(clientSession.Id)
+
+	if err := a.gameSessionManager.RemovePlayerFromSession(clientSession.Id); err != nil {
+		log.Printf("Failed to remove session %s from finished game %s: %v", clientSession.Id, gameSession.Id, err)
+		return
+	}
+
+	if opponentErr != nil {
+		return
+	}
+	if opponentSession, exists := a.sessionManager.GetSession(opponent.SessionID); exists {
+		cancelRematch(a.sender, a.queue, opponentSession, "Opponent left.")
+	}
+}
+
+func (a ResumeHandler) RequiredStates() []SessionState {
+	return []SessionState{
+		Guest,
+	}
+}
@@ -1,81 +1,315 @@
 package internal
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/transport"
+	"github.com/narik41/tictactoe-server/internal/websocket"
 )
 
+// drainPollInterval is how often Shutdown checks whether the in-progress
+// games have finished.
+const drainPollInterval = 500 * time.Millisecond
+
 type Server struct {
 	listener           net.Listener
+	wsServer           *http.Server
 	sessionManager     *SessionManager
 	gameSessionManager *GameSessionManager
+	queue              *SessionQueue
+	sender             *ResponseSender
 	msgRouter          *MessageRouter
+	disconnectHandler  *DisconnectHandler
+	heartbeat          Heartbeat
+	tlsConfig          *tls.Config // nil serves plaintext
+	wsOrigins          []string    // origins allowed to open a websocket, empty allows any
+	connections        sync.WaitGroup
+	shuttingDown       atomic.Bool
+	mu                 sync.Mutex
 }
 
-func NewServer(sessionManager *SessionManager, gameSessionManager *GameSessionManager, msgRouter *MessageRouter) *Server {
+func NewServer(sessionManager *SessionManager, gameSessionManager *GameSessionManager, queue *SessionQueue, sender *ResponseSender, msgRouter *MessageRouter, disconnectHandler *DisconnectHandler, heartbeat Heartbeat, tlsConfig *tls.Config) *Server {
 	return &Server{
 		sessionManager:     sessionManager,
 		gameSessionManager: gameSessionManager,
+		queue:              queue,
+		sender:             sender,
 		msgRouter:          msgRouter,
+		disconnectHandler:  disconnectHandler,
+		heartbeat:          heartbeat,
+		tlsConfig:          tlsConfig,
 	}
 }
 
-func (s *Server) Start(addr string) error {
+// Start listens on addr and serves connections until ctx is cancelled or
+// Shutdown is called. Connections are encrypted if the server has a TLS
+// config. It returns nil when the server stopped accepting
+// because of either of those.
+func (s *Server) Start(ctx context.Context, addr string) error {
 	log.Printf("Starting server on addr %s", addr)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	s.listener = listener
+	s.mu.Unlock()
 	log.Printf("Server started on %s", addr)
 
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stopAccepting()
+		case <-done:
+		}
+	}()
+
 	log.Printf("Listening for connections on addr %s", addr)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown.Load() {
+				log.Printf("Stopped accepting connections on addr %s", addr)
+				return nil
+			}
 			log.Printf("Client Accept error: %v", err)
 			continue
 		}
-		go s.HandleConnection(conn)
+
+		if !s.trackConnection() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.connections.Done()
+			if err := handshake(conn); err != nil {
+				log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			s.HandleConnection(transport.NewTCPConn(conn))
+		}()
 	}
 }
 
-func (s *Server) HandleConnection(conn net.Conn) {
-	log.Printf("Handling connection from %s", conn.RemoteAddr())
-	client := NewClient(conn)
-	session := s.sessionManager.CreateSession(client)
+// Shutdown stops accepting connections, matchmaking and rematches, tells every
+// connected session that the server is going down, waits for the games in
+// progress to finish and finally closes all connections. If ctx expires
+// before the games finish, the remaining connections are closed anyway and
+// ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down the server")
+	s.stopAccepting()
+	s.queue.Stop()
+	s.gameSessionManager.Drain()
+	s.notifyShutdown()
 
-	log.Printf("Session %s created for client", session.Id)
+	err := s.drainGames(ctx)
+	if err != nil {
+		log.Printf("Shutdown deadline reached with %d games in progress", s.gameSessionManager.GetInProgressCount())
+	}
 
-	// ask username and password
-	milli := time.Now().UnixMilli()
-	loginReqPayload := &core.Version1MessagePayload{
-		MessageType: core.MSG_LOGIN_REQUEST,
+	for _, session := range s.sessionManager.GetAllSessions() {
+		session.Close()
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		log.Println("All connections closed")
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// StartWebSocket serves WebSocket clients on addr at path until ctx is
+// cancelled or Shutdown is called. Their sessions are the same as those of
+// TCP clients, so players of both transports are matched against each
+// other. If allowedOrigins is not empty, browsers may only connect from
+// pages of those origins.
+func (s *Server) StartWebSocket(ctx context.Context, addr, path string, allowedOrigins []string) error {
+	log.Printf("Starting websocket server on addr %s%s", addr, path)
+	listener, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.handleWebSocket)
+	wsServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mu.Lock()
+	if s.shuttingDown.Load() {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.wsServer = wsServer
+	s.wsOrigins = allowedOrigins
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stopAccepting()
+		case <-done:
+		}
+	}()
+
+	log.Printf("Listening for websocket connections on addr %s%s", addr, path)
+	err = wsServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Stopped accepting websocket connections on addr %s", addr)
+		return nil
+	}
+	return err
+}
+
+// listen opens a TCP listener on addr, wrapped in TLS if the server has a
+// TLS config.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
 	}
+	return listener, nil
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// the hijacked connection is no longer tracked by the http server
+	if !s.trackConnection() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.connections.Done()
+
+	conn, err := websocket.Upgrade(w, r, s.wsOrigins)
+	if err != nil {
+		log.Printf("Websocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	s.HandleConnection(conn)
+}
+
+// trackConnection counts a new connection for Shutdown to wait on. It
+// returns false once the server stopped accepting, as Shutdown may already
+// be waiting then.
+func (s *Server) trackConnection() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	ticTacToeMsg := core.TicTacToeMessage{
-		MessageId: core.UUID("msg"),
-		Version:   "v1",
-		Timestamp: milli,
-		Payload:   loginReqPayload,
+	if s.shuttingDown.Load() {
+		return false
 	}
+	s.connections.Add(1)
+	return true
+}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	if err := json.NewEncoder(rw.Writer).Encode(ticTacToeMsg); err != nil {
-		log.Printf("Encoding error: %v", err)
+func (s *Server) stopAccepting() {
+	if s.shuttingDown.Swap(true) {
 		return
 	}
 
-	err := rw.Flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.wsServer != nil {
+		s.wsServer.Close()
+	}
+}
+
+func (s *Server) notifyShutdown() {
+	response := &HandlerResponse{
+		MessageType: SERVER_SHUTDOWN,
+		Payload: map[string]interface{}{
+			"message": "Server is shutting down, games in progress may finish.",
+		},
+	}
+
+	for _, session := range s.sessionManager.GetAllSessions() {
+		if err := s.sender.Send(session, response); err != nil {
+			log.Printf("Failed to notify session %s about shutdown: %v", session.GetId(), err)
+		}
+	}
+}
+
+func (s *Server) drainGames(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// the cleanup loop stops with the server, so games whose players
+		// are gone are abandoned here
+		s.gameSessionManager.AbandonOrphanedGames()
+		inProgress := s.gameSessionManager.GetInProgressCount()
+		if inProgress == 0 {
+			return nil
+		}
+		log.Printf("Waiting for %d games in progress to finish", inProgress)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandleConnection serves a client over conn until the connection fails
+// or the server shuts down.
+func (s *Server) HandleConnection(conn transport.Conn) {
+	log.Printf("Handling connection from %s", conn.RemoteAddr())
+	client := NewClient(conn)
+	session := s.sessionManager.CreateSession(client)
+	defer func() {
+		s.disconnectHandler.Handle(session)
+		<-session.writerDone
+	}()
+
+	log.Printf("Session %s created for client", session.Id)
+
+	// ask username and password
+	err := s.sender.Send(session, &HandlerResponse{
+		MessageType: core.MSG_LOGIN_REQUEST,
+	})
 	if err != nil {
-		log.Printf("Flush error: %v", err)
+		log.Printf("Failed to request login from session %s: %v", session.Id, err)
 		return
 	}
 
-	go session.ReadLoop(s.sessionManager, s.msgRouter, rw)
+	if s.heartbeat.Interval > 0 {
+		go session.heartbeatLoop(s.sender, s.heartbeat.Interval)
+	}
+
+	session.ReadLoop(s.sessionManager, s.msgRouter, s.heartbeat.IdleTimeout)
 }
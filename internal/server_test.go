@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narik41/tictactoe-helper/core"
+	"github.com/narik41/tictactoe-server/internal/game"
+	"github.com/narik41/tictactoe-server/internal/repo"
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+// testClient is the client end of a pipe served by the server.
+type testClient struct {
+	t      *testing.T
+	conn   *transport.PipeConn
+	nextID int
+}
+
+// inboundMessage is a message the server sent, with the payload left
+// undecoded.
+type inboundMessage struct {
+	InReplyTo string `json:"inReplyTo"`
+	Payload   struct {
+		MessageType core.Version1MessageType `json:"messageType"`
+		Payload     json.RawMessage          `json:"payload"`
+	} `json:"payload"`
+}
+
+// newTestServer wires a server the way main does, with the development
+// accounts and without timeouts.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	sessionManager := NewSessionManager(DuplicateLoginReject)
+	sender := NewResponseSender(sessionManager)
+	gameSessionManager := NewGameSessionManager(game.TimeControl{}, GameRetention{}, NewGameEndNotifier(sessionManager, sender).FlagFall, sessionManager.IsPresent)
+	queue := NewSessionQueue(gameSessionManager, sender)
+	queue.Start()
+	t.Cleanup(queue.Stop)
+
+	userRepo, err := repo.NewUserRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SeedDevUsers(userRepo); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewMessageRouter()
+	router.Use(RecoverMiddleware)
+	loginHandler := NewLoginHandler(userRepo, queue, sessionManager, gameSessionManager, sender, NewLoginLimiter(5, time.Minute))
+	router.RegisterHandler(core.MSG_LOGIN_PAYLOAD, loginHandler)
+	router.RegisterHandler(core.PLAYER_MOVE, NewPlayerMoveHandler(gameSessionManager, sessionManager))
+
+	disconnectHandler := NewDisconnectHandler(sessionManager, gameSessionManager, queue, sender, 0)
+	return NewServer(sessionManager, gameSessionManager, queue, sender, router, disconnectHandler, Heartbeat{}, nil)
+}
+
+// connect serves a new pipe and returns its client end. The connection is
+// closed and its session torn down when the test ends.
+func connect(t *testing.T, server *Server) *testClient {
+	t.Helper()
+
+	clientEnd, serverEnd := transport.Pipe(16)
+	var served sync.WaitGroup
+	served.Add(1)
+	go func() {
+		defer served.Done()
+		server.HandleConnection(serverEnd)
+	}()
+	t.Cleanup(func() {
+		clientEnd.Close()
+		served.Wait()
+	})
+
+	return &testClient{t: t, conn: clientEnd}
+}
+
+// send writes a v1 message and returns its id.
+func (c *testClient) send(messageType core.Version1MessageType, payload interface{}) string {
+	c.t.Helper()
+
+	c.nextID++
+	id := fmt.Sprintf("client-%d", c.nextID)
+	data, err := json.Marshal(core.TicTacToeMessage{
+		MessageId: id,
+		Version:   "v1",
+		Timestamp: time.Now().UnixMilli(),
+		Payload: core.Version1MessagePayload{
+			MessageType: messageType,
+			Payload:     payload,
+		},
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(data); err != nil {
+		c.t.Fatalf("send %s: %v", messageType, err)
+	}
+	return id
+}
+
+// expect reads messages until one of messageType arrives, skipping other
+// notifications, and decodes its payload into payload unless it is nil.
+func (c *testClient) expect(messageType core.Version1MessageType, payload interface{}) inboundMessage {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", messageType, err)
+		}
+
+		var msg inboundMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.t.Fatalf("decode %s: %v", data, err)
+		}
+		if msg.Payload.MessageType == core.ERROR {
+			c.t.Fatalf("waiting for %s, got error %s", messageType, msg.Payload.Payload)
+		}
+		if msg.Payload.MessageType != messageType {
+			continue
+		}
+
+		if payload != nil {
+			if err := json.Unmarshal(msg.Payload.Payload, payload); err != nil {
+				c.t.Fatalf("decode %s payload: %v", messageType, err)
+			}
+		}
+		return msg
+	}
+}
+
+func (c *testClient) login(username, password string) {
+	c.t.Helper()
+
+	c.expect(core.MSG_LOGIN_REQUEST, nil)
+	id := c.send(core.MSG_LOGIN_PAYLOAD, core.Version1MessageLoginPayload{Username: username, Password: password})
+
+	var response LoginResponsePayload
+	msg := c.expect(core.MSG_LOGIN_RESPONSE, &response)
+	if !response.IsAuthenticated {
+		c.t.Fatalf("login as %s refused: %s", username, response.Message)
+	}
+	if msg.InReplyTo != id {
+		c.t.Errorf("login response in reply to %q, want %q", msg.InReplyTo, id)
+	}
+}
+
+func TestLoginMatchMove(t *testing.T) {
+	server := newTestServer(t)
+	narik, santo := connect(t, server), connect(t, server)
+
+	narik.login("narik", "narik")
+	santo.login("santo", "santo")
+
+	var narikStart, santoStart GameStartPayload
+	narik.expect(core.GAME_START, &narikStart)
+	santo.expect(core.GAME_START, &santoStart)
+	if narikStart.GameId == "" || narikStart.GameId != santoStart.GameId {
+		t.Fatalf("game ids %q and %q, want the same game", narikStart.GameId, santoStart.GameId)
+	}
+	if narikStart.YourSymbol == santoStart.YourSymbol {
+		t.Fatalf("both players got %s", narikStart.YourSymbol)
+	}
+	if narikStart.YourTurn == santoStart.YourTurn {
+		t.Fatalf("your_turn is %v for both players", narikStart.YourTurn)
+	}
+
+	first, second := narik, santo
+	symbol := narikStart.YourSymbol
+	if santoStart.YourTurn {
+		first, second = santo, narik
+		symbol = santoStart.YourSymbol
+	}
+
+	id := first.send(core.PLAYER_MOVE, core.Version1PositionMoveRequestPayload{Position: 4, Symbol: symbol})
+	for _, client := range []*testClient{first, second} {
+		var moved PlayerMoveResponsePayload
+		msg := client.expect(core.PLAYER_MOVE_RESPONSE, &moved)
+		if moved.MovedToPosition != 4 || moved.MovedByUser != symbol || moved.MoveNumber != 1 {
+			t.Errorf("move response %+v, want %s on 4 as move 1", moved, symbol)
+		}
+		if client == first && msg.InReplyTo != id {
+			t.Errorf("mover's response in reply to %q, want %q", msg.InReplyTo, id)
+		}
+	}
+
+	// the second player's turn, but the square is taken
+	second.send(core.PLAYER_MOVE, core.Version1PositionMoveRequestPayload{Position: 4})
+	second.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := second.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg inboundMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload.MessageType != core.ERROR {
+		t.Errorf("move on a taken square answered with %s, want %s", msg.Payload.MessageType, core.ERROR)
+	}
+}
@@ -1,21 +1,16 @@
 package internal
 
 import (
-	"bufio"
+	"errors"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal/decoder"
-)
-
-type SessionState string
-
-const (
-	Guest          SessionState = "GUEST"
-	LoggedIn       SessionState = "LOGGED_IN"
-	WaitingForPair SessionState = "WAITING_FOR_PAIR"
-	IN_GAME        SessionState = "IN_GAME"
+	"github.com/narik41/tictactoe-server/internal/errs"
+	"github.com/narik41/tictactoe-server/internal/transport"
 )
 
 type Session struct {
@@ -23,48 +18,107 @@ type Session struct {
 	Client       *Client
 	State        SessionState
 	Username     string
+	ResumeToken  string
 	CreatedAt    int64
 	LastActivity int64
+	recent       *messageWindow       // results of the client's latest messages
+	registered   bool                 // the connection created an account, only used by the read loop
+	outbound     chan outboundMessage // encoded messages waiting for the writer
+	closing      chan struct{}        // closed to stop the writer
+	writerDone   chan struct{}        // closed once the writer returned
+	closeOnce    sync.Once
+	mu           sync.Mutex
+}
+
+// touch records that the client was just heard from.
+func (s *Session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastActivity = core.GetNPTToUtcInMillisecond()
+}
+
+// GetId returns the session id. Goroutines other than the session's reader
+// must use it, as a resume changes the id of a running session.
+func (s *Session) GetId() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Id
+}
+
+// takeIdentity makes s the session other was: same id, user and state,
+// under a new resume token. Used when a new connection resumes a held
+// session.
+func (s *Session) takeIdentity(other *Session, resumeToken string) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Id = other.Id
+	s.Username = other.Username
+	s.ResumeToken = resumeToken
+	s.CreatedAt = other.CreatedAt
+	s.State = other.State
+	s.recent = other.recent
 }
 
-func (s *Session) ReadLoop(sessionManager *SessionManager, messageRouter *MessageRouter, rw *bufio.ReadWriter) {
+// ReadLoop reads and routes the client's messages until the connection
+// fails. With a non-zero idleTimeout, a client that sends nothing for that
+// long, not even a PONG to the server's heartbeat, is disconnected.
+func (s *Session) ReadLoop(sessionManager *SessionManager, messageRouter *MessageRouter, idleTimeout time.Duration) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("ReadLoop panicked for session %s: %v", s.Id, r)
 		}
 		log.Printf("ReadLoop exited for session %s", s.Id)
 	}()
-	msgDecoder := decoder.NewMessageDecoder(rw)
+	msgDecoder := decoder.NewMessageDecoder()
 	msgSender := NewResponseSender(sessionManager)
 	for {
 		log.Printf("Reading a message of client %s", s.Id)
-		decodedMsg, err2 := msgDecoder.Decode()
+		if idleTimeout > 0 {
+			if err := s.Client.Conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+				log.Printf("Failed to set read deadline for session %s: %v", s.Id, err)
+				return
+			}
+		}
+		data, err2 := s.Client.Conn.ReadMessage()
 		if err2 != nil {
+			if errors.Is(err2, transport.ErrMessageTooLarge) {
+				log.Printf("Session %s sent a message larger than %d bytes", s.Id, transport.MaxMessageSize)
+				msgSender.SendError(s, errs.New(errs.CodeMessageTooLarge, transport.ErrMessageTooLarge.Error()), "")
+				return
+			}
 			if err2 == io.EOF {
 				log.Printf("Session %s disconnected", s.Id)
 				return
 			}
+			log.Printf("Session %s connection closed: %v", s.Id, err2)
+			return
+		}
+
+		decodedMsg, err2 := msgDecoder.Decode(data)
+		if err2 != nil {
 			log.Printf("Decode error for session %s: %v", s.Id, err2)
-			msgSender.SendError(s, "DECODE_ERROR", err2.Error())
+			msgSender.SendError(s, errs.New(errs.CodeDecodeError, err2.Error()), "")
 			continue
 		}
 		log.Printf("Session %s received %s", s.Id, decodedMsg.MessageType)
+		s.touch()
 
 		response, err2 := messageRouter.Route(decodedMsg, s)
 		if err2 != nil {
-			msgSender.SendError(s, "HANDLER_ERROR", err2.Error())
+			msgSender.SendError(s, err2, decodedMsg.MessageId)
 			continue
 		}
 
-		// based on response update the session state
-		if response != nil {
-			if response.MessageType == core.MSG_LOGIN_RESPONSE {
-				s.State = LoggedIn
-			}
+		if response == nil {
+			continue
 		}
+		response.InReplyTo = decodedMsg.MessageId
 
 		if response.Broadcast {
-			msgSender.Broadcast(response.Recipients, response)
+			msgSender.ReplyAll(s, response.Recipients, response)
 		} else {
 			msgSender.Send(s, response)
 		}
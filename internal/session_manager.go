@@ -1,19 +1,53 @@
 package internal
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/narik41/tictactoe-helper/core"
 )
 
+// DuplicateLoginPolicy decides what happens when a username that is
+// already logged in on one connection logs in on another.
+type DuplicateLoginPolicy string
+
+const (
+	// DuplicateLoginReject refuses the second login.
+	DuplicateLoginReject DuplicateLoginPolicy = "reject"
+	// DuplicateLoginKick accepts the second login and kicks the older
+	// connection, whose game seat moves to the new one.
+	DuplicateLoginKick DuplicateLoginPolicy = "kick"
+)
+
+var ErrAlreadyLoggedIn = errors.New("user is already logged in")
+
 type SessionManager struct {
-	sessions map[string]*Session // sessionId -> Session
-	mu       sync.RWMutex
+	sessions  map[string]*Session     // sessionId -> Session
+	usernames map[string]string       // username -> sessionId
+	held      map[string]*heldSession // resumeToken -> disconnected Session
+	policy    DuplicateLoginPolicy
+	mu        sync.RWMutex
 }
 
-func NewSessionManager() *SessionManager {
+// heldSession is a disconnected session whose game seat is kept until it
+// is resumed or its grace period runs out.
+type heldSession struct {
+	session *Session
+	state   SessionState // state the session had when it disconnected
+	timer   *time.Timer
+}
+
+func NewSessionManager(policy DuplicateLoginPolicy) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		sessions:  make(map[string]*Session),
+		usernames: make(map[string]string),
+		held:      make(map[string]*heldSession),
+		policy:    policy,
 	}
 }
 
@@ -22,11 +56,16 @@ func (sm *SessionManager) CreateSession(client *Client) *Session {
 	defer sm.mu.Unlock()
 
 	session := &Session{
-		Id:        core.UUID("player"),
-		Client:    client,
-		State:     Guest,
-		CreatedAt: core.GetNPTToUtcInMillisecond(),
+		Id:         core.UUID("player"),
+		Client:     client,
+		State:      Guest,
+		CreatedAt:  core.GetNPTToUtcInMillisecond(),
+		recent:     newMessageWindow(),
+		outbound:   make(chan outboundMessage, outboundQueueSize),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
 	}
+	go session.writeLoop()
 
 	sm.sessions[session.Id] = session
 	return session
@@ -39,3 +78,190 @@ func (sm *SessionManager) GetSession(sessionID string) (*Session, bool) {
 	session, exists := sm.sessions[sessionID]
 	return session, exists
 }
+
+func (sm *SessionManager) GetAllSessions() []*Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// IsPresent reports whether the session is connected or held for a
+// resume.
+func (sm *SessionManager) IsPresent(sessionID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if _, exists := sm.sessions[sessionID]; exists {
+		return true
+	}
+	for _, held := range sm.held {
+		if held.session.Id == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveSession forgets the session and reports whether it was still
+// registered, so callers can tell a first removal from a repeated one.
+func (sm *SessionManager) RemoveSession(sessionID string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	session, exists := sm.sessions[sessionID]
+	if !exists {
+		return false
+	}
+	delete(sm.sessions, sessionID)
+	if sm.usernames[session.Username] == sessionID {
+		delete(sm.usernames, session.Username)
+	}
+	return true
+}
+
+// ReturnToLobby moves the connected players of a finished game back to
+// LoggedIn.
+func (sm *SessionManager) ReturnToLobby(sessionIDs []string) {
+	for _, sessionID := range sessionIDs {
+		session, exists := sm.GetSession(sessionID)
+		if !exists {
+			continue
+		}
+		if err := session.Transition(LoggedIn); err != nil {
+			log.Printf("Failed to return session %s to the lobby: %v", sessionID, err)
+		}
+	}
+}
+
+// ClaimUsername logs the session in as username: it moves the session to
+// LoggedIn and gives it resumeToken. If another session holds the
+// username, the duplicate login policy applies: with DuplicateLoginReject
+// ErrAlreadyLoggedIn is returned, with DuplicateLoginKick the username
+// moves to session and the previous session is returned so the caller can
+// kick it and take over its seat. A session that is held after a
+// disconnect is always taken over. Nothing changes if the login fails.
+func (sm *SessionManager) ClaimUsername(session *Session, username, resumeToken string) (*Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var previous *Session
+	if previousID, exists := sm.usernames[username]; exists && previousID != session.Id {
+		if sm.policy != DuplicateLoginKick {
+			return nil, ErrAlreadyLoggedIn
+		}
+		previous = sm.sessions[previousID]
+	}
+
+	heldToken := ""
+	if previous == nil {
+		for token, held := range sm.held {
+			if held.session.Username == username {
+				heldToken = token
+				previous = held.session
+				break
+			}
+		}
+	}
+
+	if err := session.Transition(LoggedIn); err != nil {
+		return nil, err
+	}
+	if heldToken != "" {
+		sm.held[heldToken].timer.Stop()
+		delete(sm.held, heldToken)
+	}
+
+	session.Username = username
+	session.ResumeToken = resumeToken
+	sm.usernames[username] = session.Id
+	if previous != nil {
+		log.Printf("Session %s takes over user %s from session %s", session.Id, username, previous.Id)
+	}
+	return previous, nil
+}
+
+// newResumeToken makes a token a session can later present to Resume after
+// losing its connection.
+func newResumeToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Hold keeps a disconnected session, already removed from the active
+// sessions, resumable for the grace period. If it is not resumed in time,
+// expire is called with the session.
+func (sm *SessionManager) Hold(session *Session, grace time.Duration, expire func(*Session)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	token := session.ResumeToken
+	state := session.GetState()
+	if err := session.Transition(Disconnected); err != nil {
+		log.Printf("Holding session %s: %v", session.Id, err)
+	}
+	sm.held[token] = &heldSession{
+		session: session,
+		state:   state,
+		timer: time.AfterFunc(grace, func() {
+			if sm.release(token) {
+				log.Printf("Resume window of session %s expired", session.Id)
+				expire(session)
+			}
+		}),
+	}
+	log.Printf("Holding session %s (%s) for %s", session.Id, session.Username, grace)
+}
+
+// release drops a held session and reports whether it was still held.
+func (sm *SessionManager) release(token string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.held[token]; !exists {
+		return false
+	}
+	delete(sm.held, token)
+	return true
+}
+
+// Resume hands the identity of the held session with the given token over
+// to current, the session of the new connection: the held session goes
+// back to the state it had before disconnecting and current takes its id,
+// username and state, so the game seat registered under that id now
+// belongs to the new connection. The held session is discarded and the
+// token is replaced, so a token works for a single resume only.
+func (sm *SessionManager) Resume(token string, current *Session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	held, exists := sm.held[token]
+	if !exists || token == "" {
+		return fmt.Errorf("unknown or expired resume token")
+	}
+	newToken, err := newResumeToken()
+	if err != nil {
+		return err
+	}
+	delete(sm.held, token)
+	held.timer.Stop()
+
+	if err := held.session.Transition(held.state); err != nil {
+		return err
+	}
+
+	delete(sm.sessions, current.Id)
+	current.takeIdentity(held.session, newToken)
+	sm.sessions[current.Id] = current
+	sm.usernames[current.Username] = current.Id
+
+	log.Printf("Session %s (%s) resumed from %s", current.Id, current.Username, current.Client.Conn.RemoteAddr())
+	return nil
+}
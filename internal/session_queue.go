@@ -3,7 +3,7 @@ package internal
 import (
 	"fmt"
 	"log"
-	"time"
+	"sync"
 
 	"github.com/narik41/tictactoe-helper/core"
 	"github.com/narik41/tictactoe-server/internal/game"
@@ -14,6 +14,10 @@ type SessionQueue struct {
 	gameSessionManager *GameSessionManager
 	sender             *ResponseSender
 	running            bool
+	wake               chan struct{} // signalled on every enqueue
+	stop               chan struct{} // closed to stop the matchmaking loop
+	done               chan struct{} // closed once the matchmaking loop returned
+	mu                 sync.Mutex
 }
 
 func NewSessionQueue(gameSessionManager *GameSessionManager, sender *ResponseSender) *SessionQueue {
@@ -22,33 +26,60 @@ func NewSessionQueue(gameSessionManager *GameSessionManager, sender *ResponseSen
 		gameSessionManager: gameSessionManager,
 		sender:             sender,
 		running:            false,
+		wake:               make(chan struct{}, 1),
 	}
 	return mq
 }
 
 func (mq *SessionQueue) Start() {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
 	if mq.running {
-		//mq.mu.Unlock()
 		return
 	}
 	mq.running = true
+	mq.stop = make(chan struct{})
+	mq.done = make(chan struct{})
 
-	go mq.matchmakingLoop()
+	go mq.matchmakingLoop(mq.stop, mq.done)
 }
 
-func (mq *SessionQueue) Enqueue(session *Session) error {
+// Stop stops the matchmaking loop and waits for it to return. Sessions
+// already in the queue stay there until the loop is started again.
+func (mq *SessionQueue) Stop() {
+	mq.mu.Lock()
+	if !mq.running {
+		mq.mu.Unlock()
+		return
+	}
+	mq.running = false
+	close(mq.stop)
+	done := mq.done
+	mq.mu.Unlock()
 
+	<-done
+}
+
+func (mq *SessionQueue) Enqueue(session *Session) error {
+	mq.mu.Lock()
 	for _, s := range mq.queue {
 		if s.Id == session.Id {
+			mq.mu.Unlock()
 			return fmt.Errorf("session already in queue")
 		}
 	}
 
+	if err := session.Transition(WaitingForPair); err != nil {
+		mq.mu.Unlock()
+		return err
+	}
 	mq.queue = append(mq.queue, session)
-	session.State = WaitingForPair
+	queueSize := len(mq.queue)
+	mq.mu.Unlock()
 
 	log.Printf("Session %s (%s) added to session queue. Queue size: %d",
-		session.Id, session.Username, len(mq.queue))
+		session.Id, session.Username, queueSize)
 
 	mq.sender.Send(session, &HandlerResponse{
 		MessageType: core.WAITING_FOR_OPPONENT,
@@ -57,10 +88,13 @@ func (mq *SessionQueue) Enqueue(session *Session) error {
 		},
 	})
 
+	mq.signal()
 	return nil
 }
 
 func (mq *SessionQueue) Dequeue() *Session {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
 
 	if len(mq.queue) == 0 {
 		return nil
@@ -72,6 +106,8 @@ func (mq *SessionQueue) Dequeue() *Session {
 }
 
 func (mq *SessionQueue) Remove(sessionID string) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
 
 	for i, session := range mq.queue {
 		if session.Id == sessionID {
@@ -85,54 +121,92 @@ func (mq *SessionQueue) Remove(sessionID string) error {
 }
 
 func (mq *SessionQueue) Size() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
 	return len(mq.queue)
 }
 
-func (mq *SessionQueue) matchmakingLoop() {
+// signal wakes the matchmaking loop without blocking; a pending wake-up is
+// enough for the loop to see every session enqueued since.
+func (mq *SessionQueue) signal() {
+	select {
+	case mq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mq *SessionQueue) matchmakingLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
 	log.Println("Session queue loop started")
 
 	for {
-
-		if !mq.running {
-
-			break
+		for mq.matchNext() {
+			// keep pairing while two sessions wait
 		}
 
-		queueSize := len(mq.queue)
-
-		if queueSize >= 2 {
-			mq.createMatch()
-			break
+		select {
+		case <-stop:
+			log.Println("Session queue loop stopped")
+			return
+		case <-mq.wake:
 		}
-		time.Sleep(5000 * time.Millisecond)
 	}
-
-	log.Println("Session queue loop stopped")
 }
 
-func (mq *SessionQueue) createMatch() {
+// matchNext pairs the two longest waiting sessions and reports whether
+// there were two to pair.
+//
+// The pair is taken off the queue and seated under the queue lock. The
+// disconnect handler closes a session before it takes it off the queue,
+// which needs the same lock, so a player dropping out either is seen as
+// closed here or finds its seat in a game in progress afterwards and is
+// cleaned up like any other player leaving a game.
+func (mq *SessionQueue) matchNext() bool {
+	mq.mu.Lock()
+	if len(mq.queue) < 2 {
+		mq.mu.Unlock()
+		return false
+	}
 
-	player1 := mq.Dequeue()
-	player2 := mq.Dequeue()
+	player1, player2 := mq.queue[0], mq.queue[1]
+	mq.queue = mq.queue[2:]
+	gameSession := mq.createMatch(player1, player2)
+	mq.mu.Unlock()
 
-	if player1 == nil || player2 == nil {
-		if player1 != nil {
-			mq.Enqueue(player1)
-		}
-		if player2 != nil {
-			mq.Enqueue(player2)
-		}
-		return
+	if gameSession != nil {
+		notifyGameStart(mq.sender, player1, player2, gameSession)
 	}
+	return true
+}
+
+// requeue puts a session that was dequeued for a failed match back at the
+// front of the queue so it keeps its place. The caller must hold the lock.
+func (mq *SessionQueue) requeue(session *Session) {
+	mq.queue = append([]*Session{session}, mq.queue...)
+}
 
+// createMatch seats both players in a new game and starts it. If that
+// fails, the game is removed, the players that are still waiting get their
+// place back and nil is returned. The caller must hold the lock.
+func (mq *SessionQueue) createMatch(player1, player2 *Session) *game.GameSession {
 	log.Printf("Matching players: %s (%s) vs %s (%s)",
 		player1.Id, player1.Username,
 		player2.Id, player2.Username)
 
+	// a player may have dropped or left the queue between being queued
+	// and now; the other one keeps its place
+	if !isWaiting(player1) || !isWaiting(player2) {
+		log.Printf("Match of %s and %s cancelled, a player is no longer waiting", player1.Id, player2.Id)
+		mq.cancelMatch(nil, player1, player2)
+		return nil
+	}
+
 	// Create game session
 	gameSession := mq.gameSessionManager.CreateSession()
 
-	// Add both players to game
+	// Add both players to game. A player that cannot be added is dropped
+	// from the queue, otherwise the same failing pair would be retried
+	// forever.
 	err := mq.gameSessionManager.AddPlayerToSession(
 		gameSession.Id,
 		player1.Id,
@@ -140,9 +214,8 @@ func (mq *SessionQueue) createMatch() {
 	)
 	if err != nil {
 		log.Printf("Failed to add player1 to game: %v", err)
-		mq.Enqueue(player1)
-		mq.Enqueue(player2)
-		return
+		mq.cancelMatch(gameSession, player2)
+		return nil
 	}
 
 	err = mq.gameSessionManager.AddPlayerToSession(
@@ -152,45 +225,89 @@ func (mq *SessionQueue) createMatch() {
 	)
 	if err != nil {
 		log.Printf("Failed to add player2 to game: %v", err)
-		mq.gameSessionManager.RemoveSession(gameSession.Id)
-		mq.Enqueue(player1)
-		mq.Enqueue(player2)
-		return
+		mq.cancelMatch(gameSession, player1)
+		return nil
 	}
 
-	player1.State = IN_GAME
-	player2.State = IN_GAME
-	gameSession.Start()
+	if err := player1.Transition(IN_GAME); err != nil {
+		log.Printf("Failed to move player1 into the game: %v", err)
+		mq.cancelMatch(gameSession, player1, player2)
+		return nil
+	}
+	if err := player2.Transition(IN_GAME); err != nil {
+		log.Printf("Failed to move player2 into the game: %v", err)
+		mq.cancelMatch(gameSession, player1, player2)
+		return nil
+	}
+	if err := gameSession.Start(); err != nil {
+		log.Printf("Failed to start game %s: %v", gameSession.Id, err)
+		mq.cancelMatch(gameSession, player1, player2)
+		return nil
+	}
 
 	log.Printf("Game %s started between %s and %s",
-		gameSession.Game, player1.Username, player2.Username)
+		gameSession.Id, player1.Username, player2.Username)
+	return gameSession
+}
 
-	mq.notifyGameStart(player1, player2, gameSession)
+// cancelMatch removes the game of a failed match, if it was created, and
+// puts the players that are still connected back on the queue in their
+// order. A player already moved into the game goes back through the lobby,
+// as the queue cannot be entered from a game. The caller must hold the
+// lock.
+func (mq *SessionQueue) cancelMatch(gameSession *game.GameSession, players ...*Session) {
+	if gameSession != nil {
+		mq.gameSessionManager.RemoveSession(gameSession.Id)
+	}
+
+	for i := len(players) - 1; i >= 0; i-- {
+		player := players[i]
+		if player.isClosed() {
+			continue
+		}
+		if player.GetState() == IN_GAME {
+			if err := player.Transition(LoggedIn); err != nil {
+				log.Printf("Failed to take session %s out of the cancelled game: %v", player.Id, err)
+				continue
+			}
+			if err := player.Transition(WaitingForPair); err != nil {
+				log.Printf("Failed to put session %s back on the queue: %v", player.Id, err)
+				continue
+			}
+		}
+		if isWaiting(player) {
+			mq.requeue(player)
+		}
+	}
 }
 
-func (mq *SessionQueue) notifyGameStart(player1, player2 *Session, gameSession *game.GameSession) {
+// isWaiting reports whether a dequeued session is still connected and
+// waiting for an opponent.
+func isWaiting(session *Session) bool {
+	return !session.isClosed() && session.GetState() == WaitingForPair
+}
 
-	playerXInfo, _ := gameSession.GetPlayerInfo(player1.Id)
-	playerOInfo, _ := gameSession.GetPlayerInfo(player2.Id)
+func notifyGameStart(sender *ResponseSender, player1, player2 *Session, gameSession *game.GameSession) {
+	sender.Send(player1, gameStartResponse(gameSession, player1.Id))
+	sender.Send(player2, gameStartResponse(gameSession, player2.Id))
 
-	mq.sender.Send(player1, &HandlerResponse{
-		MessageType: core.GAME_START,
-		Payload: &core.Version1GameStartPayload{
-			GameId:     gameSession.Id,
-			YourSymbol: string(playerXInfo.Symbol),
-			YourTurn:   gameSession.Game.GetCurrentTurn() == playerXInfo.Symbol,
-		},
-	})
+	log.Printf("Game start notifications sent to both players")
+}
+
+// gameStartResponse tells a player of a new game its symbol and whether it
+// moves first.
+func gameStartResponse(gameSession *game.GameSession, sessionID string) *HandlerResponse {
+	playerInfo, _ := gameSession.GetPlayerInfo(sessionID)
 
-	// Notify Player 2
-	mq.sender.Send(player2, &HandlerResponse{
+	return &HandlerResponse{
 		MessageType: core.GAME_START,
-		Payload: &core.Version1GameStartPayload{
-			GameId:     gameSession.Id,
-			YourSymbol: string(playerOInfo.Symbol),
-			YourTurn:   gameSession.Game.GetCurrentTurn() == playerOInfo.Symbol,
+		Payload: &GameStartPayload{
+			Version1GameStartPayload: core.Version1GameStartPayload{
+				GameId:     gameSession.Id,
+				YourSymbol: string(playerInfo.Symbol),
+				YourTurn:   gameSession.Game.GetCurrentTurn() == playerInfo.Symbol,
+			},
+			Clock: NewClockPayload(gameSession),
 		},
-	})
-
-	log.Printf("Game start notifications sent to both players")
+	}
 }
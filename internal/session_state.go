@@ -0,0 +1,53 @@
+package internal
+
+import "fmt"
+
+type SessionState string
+
+const (
+	Guest          SessionState = "GUEST"
+	LoggedIn       SessionState = "LOGGED_IN"
+	WaitingForPair SessionState = "WAITING_FOR_PAIR"
+	IN_GAME        SessionState = "IN_GAME"
+	Disconnected   SessionState = "DISCONNECTED"
+)
+
+// sessionTransitions lists, for every state, the states a session may move
+// to next. LoggedIn is the lobby: players return there when they leave the
+// queue or their game ends.
+var sessionTransitions = map[SessionState][]SessionState{
+	Guest:          {LoggedIn},
+	LoggedIn:       {WaitingForPair, IN_GAME},
+	WaitingForPair: {IN_GAME, LoggedIn},
+	IN_GAME:        {LoggedIn, Disconnected},
+	Disconnected:   {IN_GAME, LoggedIn},
+}
+
+func canTransition(from, to SessionState) bool {
+	for _, allowed := range sessionTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GetState returns the current state of the session.
+func (s *Session) GetState() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.State
+}
+
+// Transition moves the session to the given state, failing if the state
+// machine does not allow that move from the current state.
+func (s *Session) Transition(to SessionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !canTransition(s.State, to) {
+		return fmt.Errorf("illegal session state transition %s -> %s", s.State, to)
+	}
+	s.State = to
+	return nil
+}
@@ -0,0 +1,63 @@
+package internal
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to SessionState
+		want     bool
+	}{
+		{Guest, LoggedIn, true},
+		{Guest, WaitingForPair, false},
+		{Guest, IN_GAME, false},
+		{Guest, Disconnected, false},
+
+		{LoggedIn, WaitingForPair, true},
+		{LoggedIn, IN_GAME, true},
+		{LoggedIn, Guest, false},
+		{LoggedIn, Disconnected, false},
+
+		{WaitingForPair, IN_GAME, true},
+		{WaitingForPair, LoggedIn, true},
+		{WaitingForPair, Guest, false},
+		{WaitingForPair, Disconnected, false},
+
+		{IN_GAME, LoggedIn, true},
+		{IN_GAME, Disconnected, true},
+		{IN_GAME, WaitingForPair, false},
+		{IN_GAME, IN_GAME, false},
+
+		{Disconnected, IN_GAME, true},
+		{Disconnected, LoggedIn, true},
+		{Disconnected, WaitingForPair, false},
+		{Disconnected, Guest, false},
+
+		{"UNKNOWN", LoggedIn, false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestSessionTransition(t *testing.T) {
+	session := &Session{State: Guest}
+
+	if err := session.Transition(IN_GAME); err == nil {
+		t.Fatal("Transition(IN_GAME) from GUEST succeeded, want an error")
+	}
+	if got := session.GetState(); got != Guest {
+		t.Fatalf("state after a refused transition = %s, want %s", got, Guest)
+	}
+
+	for _, to := range []SessionState{LoggedIn, WaitingForPair, IN_GAME, LoggedIn} {
+		if err := session.Transition(to); err != nil {
+			t.Fatalf("Transition(%s): %v", to, err)
+		}
+		if got := session.GetState(); got != to {
+			t.Fatalf("state = %s, want %s", got, to)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+const (
+	// outboundQueueSize is how many encoded messages may wait for a session's
+	// writer before the client is considered too slow and disconnected.
+	outboundQueueSize = 64
+
+	// writeTimeout bounds a single write to the client's connection.
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrSlowConsumer  = errors.New("outbound queue full")
+)
+
+// outboundMessage is an encoded message waiting for the writer. A non-empty
+// framing switches the connection's write framing right after the message
+// was written in the old one.
+type outboundMessage struct {
+	data    []byte
+	framing transport.Framing
+}
+
+// QueueMessage hands an encoded message to the session's writer. It never
+// blocks: if the outbound queue is full the client is not keeping up and
+// its connection is dropped, which feeds the normal disconnect path.
+func (s *Session) QueueMessage(data []byte) error {
+	return s.queue(outboundMessage{data: data})
+}
+
+// QueueFramingSwitch queues data like QueueMessage and switches the write
+// framing to framing once data is written, so every message queued after
+// it uses the new framing.
+func (s *Session) QueueFramingSwitch(data []byte, framing transport.Framing) error {
+	return s.queue(outboundMessage{data: data, framing: framing})
+}
+
+func (s *Session) queue(msg outboundMessage) error {
+	select {
+	case <-s.closing:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case s.outbound <- msg:
+		return nil
+	default:
+		log.Printf("Outbound queue of session %s is full, disconnecting", s.GetId())
+		s.Close()
+		s.Client.Close()
+		return ErrSlowConsumer
+	}
+}
+
+// Close stops the session's writer once the messages already queued are
+// written, then closes the connection. It is safe to call more than once.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+// isClosed reports whether Close was called.
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLoop is the only goroutine writing to the session's connection.
+func (s *Session) writeLoop() {
+	defer close(s.writerDone)
+	defer s.Client.Close()
+
+	for {
+		select {
+		case msg := <-s.outbound:
+			if err := s.write(msg); err != nil {
+				log.Printf("Write to session %s failed: %v", s.GetId(), err)
+				return
+			}
+		case <-s.closing:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush writes what is left in the outbound queue.
+func (s *Session) flush() {
+	for {
+		select {
+		case msg := <-s.outbound:
+			if err := s.write(msg); err != nil {
+				log.Printf("Write to session %s failed: %v", s.GetId(), err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) write(msg outboundMessage) error {
+	if err := s.Client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	if err := s.Client.Conn.WriteMessage(msg.data); err != nil {
+		return err
+	}
+
+	if msg.framing == "" {
+		return nil
+	}
+	framer, ok := s.Client.Conn.(transport.Framer)
+	if !ok {
+		return fmt.Errorf("connection does not support framing %s", msg.framing)
+	}
+	return framer.SetWriteFraming(msg.framing)
+}
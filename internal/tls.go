@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS
+// handshake after connecting.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ClientAuth says whether clients have to present a certificate.
+type ClientAuth string
+
+const (
+	ClientAuthNone     ClientAuth = "none"     // client certificates are not asked for
+	ClientAuthOptional ClientAuth = "optional" // a certificate is verified if the client sends one
+	ClientAuthRequire  ClientAuth = "require"  // every client must send a valid certificate
+)
+
+// TLS configures encryption of the client listeners. The zero value serves
+// plaintext.
+type TLS struct {
+	CertFile     string     // PEM certificate chain of the server
+	KeyFile      string     // PEM private key of the server
+	MinVersion   string     // lowest protocol version accepted: 1.2 or 1.3
+	ClientAuth   ClientAuth // whether client certificates are verified
+	ClientCAFile string     // PEM bundle of the CAs client certificates must chain to
+	SelfSigned   bool       // generate a throwaway certificate for local testing instead of loading one
+}
+
+func (t TLS) Enabled() bool {
+	return t.SelfSigned || t.CertFile != "" || t.KeyFile != ""
+}
+
+// Config builds the tls.Config described by t, or returns nil if TLS is
+// disabled.
+func (t TLS) Config() (*tls.Config, error) {
+	if !t.Enabled() {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	switch t.MinVersion {
+	case "", "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", t.MinVersion)
+	}
+
+	if t.SelfSigned {
+		if t.CertFile != "" || t.KeyFile != "" {
+			return nil, fmt.Errorf("a self-signed certificate cannot be combined with a certificate file")
+		}
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch t.ClientAuth {
+	case "", ClientAuthNone:
+		if t.ClientCAFile != "" {
+			return nil, fmt.Errorf("a client CA file needs client certificate auth")
+		}
+		return config, nil
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client certificate auth %q", t.ClientAuth)
+	}
+
+	if t.ClientCAFile == "" {
+		return nil, fmt.Errorf("client certificate auth needs a client CA file")
+	}
+	pem, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA file: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", t.ClientCAFile)
+	}
+
+	return config, nil
+}
+
+// selfSignedCertificate creates a short lived certificate for localhost. It
+// is not trusted by anyone, so clients have to skip verification or pin it.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// handshake completes the TLS handshake of conn within tlsHandshakeTimeout,
+// so a client that never finishes it does not hold on to a connection.
+// Plaintext connections are left alone.
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if err := tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pipeAddr is the address of both ends of a pipe.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeConn is one end of an in-memory connection made by Pipe. Messages
+// keep their boundaries and need no framing. Deadlines apply to calls
+// started after they are set.
+type PipeConn struct {
+	in  <-chan []byte
+	out chan<- []byte
+
+	closed    chan struct{} // closed by this end
+	remote    chan struct{} // closed by the other end
+	closeOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// Pipe returns the two ends of an in-memory connection, e.g. to run a
+// session in the same process as its client. A message written to one end
+// is read from the other; up to buffer messages are held without a
+// reader.
+func Pipe(buffer int) (*PipeConn, *PipeConn) {
+	aToB := make(chan []byte, buffer)
+	bToA := make(chan []byte, buffer)
+	aClosed := make(chan struct{})
+	bClosed := make(chan struct{})
+
+	a := &PipeConn{in: bToA, out: aToB, closed: aClosed, remote: bClosed}
+	b := &PipeConn{in: aToB, out: bToA, closed: bClosed, remote: aClosed}
+	return a, b
+}
+
+func (c *PipeConn) ReadMessage() ([]byte, error) {
+	timeout, stop := c.readDeadline.wait()
+	defer stop()
+
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.remote:
+		// deliver what the other end wrote before it closed
+		select {
+		case data := <-c.in:
+			return data, nil
+		default:
+			return nil, io.EOF
+		}
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *PipeConn) WriteMessage(data []byte) error {
+	timeout, stop := c.writeDeadline.wait()
+	defer stop()
+
+	message := append([]byte(nil), data...)
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.remote:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	select {
+	case c.out <- message:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.remote:
+		return io.ErrClosedPipe
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *PipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *PipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *PipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *PipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a point in time after which blocking calls give up. The
+// zero value means no deadline.
+type deadline struct {
+	at time.Time
+	mu sync.Mutex
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	d.at = t
+	d.mu.Unlock()
+}
+
+// wait returns a channel that is ready once the deadline passed, and a
+// function to release it.
+func (d *deadline) wait() (<-chan time.Time, func()) {
+	d.mu.Lock()
+	at := d.at
+	d.mu.Unlock()
+
+	if at.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(at))
+	return timer.C, func() { timer.Stop() }
+}
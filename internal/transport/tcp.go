@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// MaxMessageSize bounds a message a client may send over TCP, in either
+// framing.
+const MaxMessageSize = 64 * 1024
+
+// lengthPrefixSize is the size of the big endian length in front of every
+// length-prefixed message.
+const lengthPrefixSize = 4
+
+var ErrMessageTooLarge = fmt.Errorf("message larger than %d bytes", MaxMessageSize)
+
+// Framing is how messages are delimited on a stream connection.
+type Framing string
+
+const (
+	FramingNewline        Framing = "NEWLINE"         // one message per line, the default
+	FramingLengthPrefixed Framing = "LENGTH_PREFIXED" // a 4 byte big endian length, then the message
+)
+
+func (f Framing) Valid() bool {
+	return f == FramingNewline || f == FramingLengthPrefixed
+}
+
+// Framer is implemented by connections whose framing can be changed after
+// they were opened. Reads and writes switch separately, so each side can
+// switch at the right point in its own stream.
+type Framer interface {
+	// SetReadFraming applies to every message read after it returns. It
+	// must be called from the goroutine that reads.
+	SetReadFraming(framing Framing) error
+	// SetWriteFraming applies to every message written after it returns. It
+	// must be called from the goroutine that writes.
+	SetWriteFraming(framing Framing) error
+}
+
+// TCPConn frames messages on a stream connection, as newline terminated
+// lines until a Framer switch says otherwise.
+type TCPConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	readFraming  Framing // only used by the reading goroutine
+	writeFraming Framing // only used by the writing goroutine
+}
+
+func NewTCPConn(conn net.Conn) *TCPConn {
+	return &TCPConn{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		readFraming:  FramingNewline,
+		writeFraming: FramingNewline,
+	}
+}
+
+func (c *TCPConn) ReadMessage() ([]byte, error) {
+	if c.readFraming == FramingLengthPrefixed {
+		return c.readLengthPrefixed()
+	}
+	return c.readLine()
+}
+
+// readLine reads up to the next newline, giving up with ErrMessageTooLarge
+// once the line is longer than MaxMessageSize, so a client that never
+// sends a newline cannot make the server buffer without bound.
+func (c *TCPConn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxMessageSize+len("\r\n") {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) > MaxMessageSize {
+				return nil, ErrMessageTooLarge
+			}
+			return line, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+}
+
+func (c *TCPConn) readLengthPrefixed() ([]byte, error) {
+	var prefix [lengthPrefixSize]byte
+	if _, err := io.ReadFull(c.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, message); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *TCPConn) WriteMessage(data []byte) error {
+	var buffers net.Buffers
+	if c.writeFraming == FramingLengthPrefixed {
+		var prefix [lengthPrefixSize]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+		buffers = net.Buffers{prefix[:], data}
+	} else {
+		buffers = net.Buffers{data, []byte{'\n'}}
+	}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+func (c *TCPConn) SetReadFraming(framing Framing) error {
+	if !framing.Valid() {
+		return fmt.Errorf("unknown framing %q", framing)
+	}
+	c.readFraming = framing
+	return nil
+}
+
+func (c *TCPConn) SetWriteFraming(framing Framing) error {
+	if !framing.Valid() {
+		return fmt.Errorf("unknown framing %q", framing)
+	}
+	c.writeFraming = framing
+	return nil
+}
+
+func (c *TCPConn) Close() error                       { return c.conn.Close() }
+func (c *TCPConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *TCPConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *TCPConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// readerConn returns a TCPConn that reads data in framing.
+func readerConn(data []byte, framing Framing) *TCPConn {
+	return &TCPConn{
+		reader:       bufio.NewReader(bytes.NewReader(data)),
+		readFraming:  framing,
+		writeFraming: FramingNewline,
+	}
+}
+
+func lengthPrefixed(message []byte) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+}
+
+func TestReadLine(t *testing.T) {
+	maxMessage := bytes.Repeat([]byte("a"), MaxMessageSize)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr error
+	}{
+		{"line", []byte("hello\n"), []byte("hello"), nil},
+		{"carriage return", []byte("hello\r\n"), []byte("hello"), nil},
+		{"empty line", []byte("\n"), []byte{}, nil},
+		{"largest message", append(maxMessage, '\n'), maxMessage, nil},
+		{"largest message with carriage return", append(maxMessage, "\r\n"...), maxMessage, nil},
+		{"one byte too large", append(append(maxMessage, 'a'), '\n'), nil, ErrMessageTooLarge},
+		{"one byte too large with carriage return", append(append(maxMessage, 'a'), "\r\n"...), nil, ErrMessageTooLarge},
+		{"never ending line", bytes.Repeat([]byte("a"), 4*MaxMessageSize), nil, ErrMessageTooLarge},
+		{"unterminated line", []byte("hello"), nil, io.EOF},
+		{"nothing", nil, nil, io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readerConn(tt.data, FramingNewline).ReadMessage()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("message of %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReadLengthPrefixed(t *testing.T) {
+	maxMessage := bytes.Repeat([]byte("a"), MaxMessageSize)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr error
+	}{
+		{"message", append(lengthPrefixed([]byte("hello")), "hello"...), []byte("hello"), nil},
+		{"newline inside", append(lengthPrefixed([]byte("a\nb")), "a\nb"...), []byte("a\nb"), nil},
+		{"empty message", lengthPrefixed(nil), []byte{}, nil},
+		{"largest message", append(lengthPrefixed(maxMessage), maxMessage...), maxMessage, nil},
+		{"one byte too large", binary.BigEndian.AppendUint32(nil, MaxMessageSize+1), nil, ErrMessageTooLarge},
+		{"huge length", []byte{0xFF, 0xFF, 0xFF, 0xFF}, nil, ErrMessageTooLarge},
+		{"truncated message", append(lengthPrefixed([]byte("hello")), "hel"...), nil, io.ErrUnexpectedEOF},
+		{"truncated length", []byte{0, 0}, nil, io.ErrUnexpectedEOF},
+		{"nothing", nil, nil, io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readerConn(tt.data, FramingLengthPrefixed).ReadMessage()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("message of %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestTCPConnFramingSwitch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writer, reader := NewTCPConn(server), NewTCPConn(client)
+
+	messages := []struct {
+		data    []byte
+		framing Framing
+	}{
+		{[]byte("first"), FramingNewline},
+		{[]byte("second\nline"), FramingLengthPrefixed},
+		{[]byte("third"), FramingNewline},
+	}
+
+	go func() {
+		for _, message := range messages {
+			if err := writer.SetWriteFraming(message.framing); err != nil {
+				t.Errorf("SetWriteFraming(%s): %v", message.framing, err)
+				return
+			}
+			if err := writer.WriteMessage(message.data); err != nil {
+				t.Errorf("WriteMessage: %v", err)
+				return
+			}
+		}
+	}()
+
+	for _, message := range messages {
+		if err := reader.SetReadFraming(message.framing); err != nil {
+			t.Fatalf("SetReadFraming(%s): %v", message.framing, err)
+		}
+		got, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if !bytes.Equal(got, message.data) {
+			t.Errorf("read %q in %s framing, want %q", got, message.framing, message.data)
+		}
+	}
+}
+
+func TestSetFramingRejectsUnknown(t *testing.T) {
+	conn := readerConn(nil, FramingNewline)
+	if err := conn.SetReadFraming("BINARY"); err == nil {
+		t.Error("SetReadFraming(BINARY) succeeded, want an error")
+	}
+	if err := conn.SetWriteFraming(""); err == nil {
+		t.Error("SetWriteFraming(\"\") succeeded, want an error")
+	}
+}
@@ -0,0 +1,25 @@
+// Package transport carries whole messages between the server and a
+// client. Sessions only see a Conn, so the same session logic serves every
+// kind of connection.
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// Conn is a connection to a client that reads and writes whole encoded
+// messages, the framing is up to the implementation. ReadMessage and
+// WriteMessage may be called from different goroutines, but each only from
+// one at a time.
+type Conn interface {
+	// ReadMessage returns the next message without its framing. Any error
+	// means the connection can no longer be read.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends one message, adding the framing.
+	WriteMessage(data []byte) error
+	Close() error
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
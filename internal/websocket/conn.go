@@ -0,0 +1,261 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+
+	// closeTimeout bounds writing the close frame when the server closes
+	// the connection.
+	closeTimeout = time.Second
+)
+
+// ProtocolError is returned by ReadMessage when the client broke the
+// protocol. The connection is closed afterwards.
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string { return "websocket: " + e.Message }
+
+var errProtocol = &ProtocolError{Message: "protocol error"}
+
+// Conn is a WebSocket connection carrying one message per WebSocket
+// message. Messages are sent as text. It is safe to read and write from
+// different goroutines.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu   sync.Mutex
+	closed    bool
+	closeCode uint16 // status code sent by Close, closeNormal if zero
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: reader,
+	}
+}
+
+// ReadMessage returns the next text or binary message of the client. A
+// message larger than transport.MaxMessageSize fails with an error
+// wrapping transport.ErrMessageTooLarge; the connection is left open so
+// the caller can tell the client before it closes the connection, which
+// then reports status 1009.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	return c.readMessage()
+}
+
+// WriteMessage sends data as one text message.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Close sends a close frame and closes the connection.
+func (c *Conn) Close() error {
+	c.writeMu.Lock()
+	if !c.closed {
+		code := c.closeCode
+		if code == 0 {
+			code = closeNormal
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrameLocked(opClose, closePayload(code))
+		c.closed = true
+	}
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// readMessage reads frames until a complete data message arrived,
+// answering control frames on the way. A close frame ends the stream
+// with io.EOF.
+func (c *Conn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeMu.Lock()
+			if !c.closed {
+				c.writeFrameLocked(opClose, closePayload(closeNormal))
+				c.closed = true
+			}
+			c.writeMu.Unlock()
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, c.fail(closeProtocolError, errProtocol)
+			}
+			started = true
+			message = append(message, payload...)
+		case opContinuation:
+			if !started {
+				return nil, c.fail(closeProtocolError, errProtocol)
+			}
+			message = append(message, payload...)
+		default:
+			return nil, c.fail(closeProtocolError, &ProtocolError{Message: fmt.Sprintf("unknown opcode %d", opcode)})
+		}
+
+		if len(message) > transport.MaxMessageSize {
+			return nil, c.tooLarge()
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(closeProtocolError, errProtocol)
+	}
+
+	// clients must mask every frame
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(closeProtocolError, errProtocol)
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if opcode >= opClose && (length > 125 || !fin) {
+		return false, 0, nil, c.fail(closeProtocolError, errProtocol)
+	}
+	if length > transport.MaxMessageSize {
+		return false, 0, nil, c.tooLarge()
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes a single unmasked frame. The caller must hold
+// writeMu.
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode)
+
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+// tooLarge makes Close report status 1009 and returns the error for a
+// message over the size limit. The rest of the message is not read, so
+// the connection cannot be read any more.
+func (c *Conn) tooLarge() error {
+	c.writeMu.Lock()
+	c.closeCode = closeTooBig
+	c.writeMu.Unlock()
+	return fmt.Errorf("websocket: %w", transport.ErrMessageTooLarge)
+}
+
+// fail closes the connection with the status code and returns err.
+func (c *Conn) fail(code uint16, err *ProtocolError) error {
+	c.writeMu.Lock()
+	if !c.closed {
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrameLocked(opClose, closePayload(code))
+		c.closed = true
+	}
+	c.writeMu.Unlock()
+	c.conn.Close()
+	return err
+}
+
+func closePayload(code uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, code)
+}
@@ -0,0 +1,300 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/narik41/tictactoe-server/internal/transport"
+)
+
+type frame struct {
+	opcode  byte
+	payload []byte
+}
+
+// clientFrame encodes a frame the way a client sends it, masked unless
+// unmasked is set.
+func clientFrame(fin bool, opcode byte, payload []byte, unmasked bool) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	data := []byte{first}
+
+	maskBit := byte(0x80)
+	if unmasked {
+		maskBit = 0
+	}
+	switch length := len(payload); {
+	case length < 126:
+		data = append(data, maskBit|byte(length))
+	case length <= 0xFFFF:
+		data = append(data, maskBit|126)
+		data = binary.BigEndian.AppendUint16(data, uint16(length))
+	default:
+		data = append(data, maskBit|127)
+		data = binary.BigEndian.AppendUint64(data, uint64(length))
+	}
+	if unmasked {
+		return append(data, payload...)
+	}
+
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	data = append(data, mask[:]...)
+	for i, b := range payload {
+		data = append(data, b^mask[i%4])
+	}
+	return data
+}
+
+func text(payload string) []byte {
+	return clientFrame(true, opText, []byte(payload), false)
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// parseServerFrames decodes the unmasked frames the server wrote.
+func parseServerFrames(t *testing.T, data []byte) []frame {
+	t.Helper()
+
+	var frames []frame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatalf("truncated frame header % x", data)
+		}
+		opcode, length := data[0]&0x0F, int(data[1]&0x7F)
+		data = data[2:]
+		switch length {
+		case 126:
+			length = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		case 127:
+			length = int(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		}
+		frames = append(frames, frame{opcode: opcode, payload: data[:length]})
+		data = data[length:]
+	}
+	return frames
+}
+
+func closeFrame(code uint16) frame {
+	return frame{opcode: opClose, payload: closePayload(code)}
+}
+
+func TestReadMessage(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 300)
+	maxMessage := bytes.Repeat([]byte("a"), transport.MaxMessageSize)
+	half := bytes.Repeat([]byte("a"), transport.MaxMessageSize/2+1)
+
+	tests := []struct {
+		name              string
+		input             []byte
+		want              []byte
+		wantErr           error // matched with errors.Is
+		wantProtocolError bool
+		wantFrames        []frame // written by the server, including the final Close
+	}{
+		{
+			name:       "text",
+			input:      text("hello"),
+			want:       []byte("hello"),
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name:       "binary",
+			input:      clientFrame(true, opBinary, []byte{0, 1, 2}, false),
+			want:       []byte{0, 1, 2},
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name:       "16 bit length",
+			input:      clientFrame(true, opText, large, false),
+			want:       large,
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name:       "largest message",
+			input:      clientFrame(true, opText, maxMessage, false),
+			want:       maxMessage,
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name: "fragmented",
+			input: concat(
+				clientFrame(false, opText, []byte("hel"), false),
+				clientFrame(false, opContinuation, []byte("l"), false),
+				clientFrame(true, opContinuation, []byte("o"), false),
+			),
+			want:       []byte("hello"),
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name: "ping between fragments",
+			input: concat(
+				clientFrame(false, opText, []byte("hel"), false),
+				clientFrame(true, opPing, []byte("are you there"), false),
+				clientFrame(true, opContinuation, []byte("lo"), false),
+			),
+			want: []byte("hello"),
+			wantFrames: []frame{
+				{opcode: opPong, payload: []byte("are you there")},
+				closeFrame(closeNormal),
+			},
+		},
+		{
+			name:       "pong is ignored",
+			input:      concat(clientFrame(true, opPong, nil, false), text("hello")),
+			want:       []byte("hello"),
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name:       "close",
+			input:      clientFrame(true, opClose, closePayload(closeNormal), false),
+			wantErr:    io.EOF,
+			wantFrames: []frame{closeFrame(closeNormal)},
+		},
+		{
+			name:              "unmasked",
+			input:             clientFrame(true, opText, []byte("hello"), true),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name:              "reserved bits",
+			input:             append([]byte{0x80 | 0x40 | opText}, text("hello")[1:]...),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name:              "continuation without a start",
+			input:             clientFrame(true, opContinuation, []byte("lo"), false),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name: "new message inside a fragmented one",
+			input: concat(
+				clientFrame(false, opText, []byte("hel"), false),
+				text("lo"),
+			),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name:              "control frame too long",
+			input:             clientFrame(true, opPing, large, false),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name:              "fragmented control frame",
+			input:             clientFrame(false, opPing, []byte("hi"), false),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			name:              "unknown opcode",
+			input:             clientFrame(true, 0x3, []byte("hi"), false),
+			wantProtocolError: true,
+			wantFrames:        []frame{closeFrame(closeProtocolError)},
+		},
+		{
+			// only the header is sent, the length alone must be refused
+			name:       "frame too large",
+			input:      clientFrame(true, opText, append(maxMessage, 'a'), false)[:10],
+			wantErr:    transport.ErrMessageTooLarge,
+			wantFrames: []frame{closeFrame(closeTooBig)},
+		},
+		{
+			name: "fragments too large",
+			input: concat(
+				clientFrame(false, opText, half, false),
+				clientFrame(true, opContinuation, half, false),
+			),
+			wantErr:    transport.ErrMessageTooLarge,
+			wantFrames: []frame{closeFrame(closeTooBig)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			conn := newConn(server, bufio.NewReader(server))
+
+			received := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(client)
+				received <- data
+			}()
+			go client.Write(tt.input)
+
+			got, err := conn.ReadMessage()
+			conn.Close()
+
+			var protocolErr *ProtocolError
+			switch {
+			case tt.wantProtocolError:
+				if !errors.As(err, &protocolErr) {
+					t.Fatalf("err = %v, want a protocol error", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("message of %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+
+			frames := parseServerFrames(t, <-received)
+			if len(frames) != len(tt.wantFrames) {
+				t.Fatalf("server wrote %d frames %v, want %v", len(frames), frames, tt.wantFrames)
+			}
+			for i, want := range tt.wantFrames {
+				if frames[i].opcode != want.opcode || !bytes.Equal(frames[i].payload, want.payload) {
+					t.Errorf("frame %d = %v, want %v", i, frames[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newConn(server, bufio.NewReader(server))
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- data
+	}()
+
+	messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte("a"), 300), bytes.Repeat([]byte("b"), 70000)}
+	for _, message := range messages {
+		if err := conn.WriteMessage(message); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	conn.Close()
+	if err := conn.WriteMessage([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteMessage after Close = %v, want %v", err, net.ErrClosed)
+	}
+
+	frames := parseServerFrames(t, <-received)
+	if len(frames) != len(messages)+1 {
+		t.Fatalf("server wrote %d frames, want %d", len(frames), len(messages)+1)
+	}
+	for i, message := range messages {
+		if frames[i].opcode != opText || !bytes.Equal(frames[i].payload, message) {
+			t.Errorf("frame %d is opcode %d with %d bytes, want a text frame with %d bytes", i, frames[i].opcode, len(frames[i].payload), len(message))
+		}
+	}
+}
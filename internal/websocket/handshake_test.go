@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455, section 1.3
+	if got, want := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("acceptKey = %s, want %s", got, want)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://play.example.com", "http://localhost:8080"}
+
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"https://evil.example", nil, true},
+		{"https://play.example.com", allowed, true},
+		{"HTTPS://PLAY.EXAMPLE.COM", allowed, true},
+		{"http://localhost:8080", allowed, true},
+		{"http://play.example.com", allowed, false},
+		{"https://play.example.com:8443", allowed, false},
+		{"https://evil.example", allowed, false},
+		{"null", allowed, false},
+	}
+
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, tt.allowed); got != tt.want {
+			t.Errorf("originAllowed(%q, %v) = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeRefusesBadRequests(t *testing.T) {
+	allowed := []string{"https://play.example.com"}
+
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"post", http.MethodPost, nil, http.StatusMethodNotAllowed},
+		{"plain http", http.MethodGet, map[string]string{"Sec-WebSocket-Version": "13"}, http.StatusUpgradeRequired},
+		{"old version", http.MethodGet, map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"bad key", http.MethodGet, map[string]string{"Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"foreign origin", http.MethodGet, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/ws", nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if tt.name == "plain http" {
+				r.Header.Del("Connection")
+				r.Header.Del("Upgrade")
+			}
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r, allowed); err == nil {
+				t.Fatal("Upgrade succeeded, want an error")
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}